@@ -7,17 +7,26 @@ This is used in conjunction with https://github.com/codegangsta/cli
 package command
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"log"
 
 	"github.com/codegangsta/cli"
 
+	"net/http"
 	"os"
 	"os/signal"
+	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"github.com/johnnadratowski/batch/app/model"
+	"github.com/johnnadratowski/batch/app/route"
 )
 
+var WORKER_LISTEN string = ""
+
 var Commands []cli.Command = []cli.Command{
 	{
 		Name:  "worker",
@@ -25,26 +34,422 @@ var Commands []cli.Command = []cli.Command{
 		Flags: []cli.Flag{
 			cli.IntFlag{
 				Name:  "workers, w",
-				Usage: "The number of workers to start",
+				Usage: "The number of async batch items to process at once",
 				Value: 1,
 			},
+			cli.IntFlag{
+				Name:  "min-workers",
+				Usage: "The fewest async batch items to process at once when scaling down. Defaults to --workers",
+				Value: model.WORKERS_MIN,
+			},
+			cli.IntFlag{
+				Name:  "max-workers",
+				Usage: "The most async batch items to process at once when scaling up. Defaults to --workers",
+				Value: model.WORKERS_MAX,
+			},
+			cli.StringFlag{
+				Name:  "listen",
+				Usage: "The address for the health and introspection HTTP listener, e.g. :8088. Not started if empty",
+				Value: WORKER_LISTEN,
+			},
 		},
 		Action: func(c *cli.Context) {
+			model.WORKERS_MIN = c.Int("min-workers")
+			model.WORKERS_MAX = c.Int("max-workers")
+
+			// Traces are still passed on to downstream requests if the exporter can't start
+			shutdownTracing, _ := model.InitTracing()
+
 			catchSignal := make(chan os.Signal, 1)
 			quit := make(chan bool, 1)
 			finished := make(chan bool, 1)
-			signal.Notify(catchSignal, os.Interrupt)
+			signal.Notify(catchSignal, os.Interrupt, syscall.SIGTERM)
 			go model.StartAsyncWorkers(c.Int("workers"), quit, finished)
-			<-catchSignal
-			log.Println("Caught interrupt signal. Waiting for workers to finish.")
+
+			quitSchedules := make(chan bool, 1)
+			finishedSchedules := make(chan bool, 1)
+			go model.StartBatchScheduleRunner(quitSchedules, finishedSchedules)
+
+			if listen := c.String("listen"); listen != "" {
+				log.Printf("Starting worker HTTP listener on %s", listen)
+				go func() {
+					err := http.ListenAndServe(listen, route.WorkerRouter())
+					log.Printf("Exiting worker HTTP listener: %s", err)
+				}()
+			}
+
+			sig := <-catchSignal
+			log.Printf("Caught %s signal. Waiting up to %s for workers to finish.", sig, model.DrainTimeout())
 			quit <- true
+			quitSchedules <- true
 
 			select {
 			case <-finished:
 				log.Println("All workers finished. Shutdown successfully")
-			case <-time.After(3 * time.Second):
+			case <-time.After(model.DrainTimeout() + 3*time.Second):
 				log.Println("All workers DID NOT finished. Forcefully shutting down")
 			}
+
+			select {
+			case <-finishedSchedules:
+				log.Println("Batch schedule runner finished. Shutdown successfully")
+			case <-time.After(1 * time.Second):
+				log.Println("Batch schedule runner DID NOT finish. Forcefully shutting down")
+			}
+
+			model.CloseAsyncBatchProducer()
+			shutdownTracing()
 		},
 	},
+	{
+		Name:  "run",
+		Usage: "Run a batch from a JSON or YAML file, or stdin. Usage: run [file]",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "server, s",
+				Usage: "The URL of the batch server to send the batch to, e.g. http://localhost:8087. Ran locally if empty",
+			},
+			cli.BoolFlag{
+				Name:  "async, a",
+				Usage: "Send the batch as an async batch request and wait for it to finish. Requires --server",
+			},
+			cli.StringSliceFlag{
+				Name:  "header, H",
+				Usage: "A header to send to the batch server, as \"Name: value\". Can be repeated",
+				Value: &cli.StringSlice{},
+			},
+			cli.StringFlag{
+				Name:  "identity",
+				Usage: "The identity ID to run the batch as when it's ran locally",
+			},
+			cli.StringFlag{
+				Name:  "output, o",
+				Usage: "How to print the results: json, ndjson or table",
+				Value: OutputJSON,
+			},
+			cli.DurationFlag{
+				Name:  "poll",
+				Usage: "How often to check on an async batch request",
+				Value: time.Second,
+			},
+			cli.DurationFlag{
+				Name:  "timeout",
+				Usage: "How long to wait for an async batch request. Waits forever if 0",
+			},
+		},
+		Action: func(c *cli.Context) {
+			output := c.String("output")
+			if !validOutput(output) {
+				log.Fatalln("Unknown output format:", output)
+			}
+
+			request, err := readBatchDefinition(c.Args().First())
+			if err != nil {
+				log.Fatalln("An error occurred reading the batch:", err)
+			}
+
+			var batchResponse model.BatchResponse
+			if server := c.String("server"); server == "" {
+				if c.Bool("async") {
+					log.Fatalln("Async batches can only be ran on a batch server, with --server")
+				}
+				batchResponse = request.Items.RunBatch(context.Background(), c.String("identity"))
+			} else {
+				client, err := newBatchServerClient(server, c.StringSlice("header"))
+				if err != nil {
+					log.Fatalln(err)
+				}
+
+				if c.Bool("async") {
+					ctx := context.Background()
+					if timeout := c.Duration("timeout"); timeout > 0 {
+						var cancel context.CancelFunc
+						ctx, cancel = context.WithTimeout(ctx, timeout)
+						defer cancel()
+					}
+					batchResponse, err = client.RunBatchAsync(ctx, request, c.Duration("poll"))
+				} else {
+					batchResponse, err = client.RunBatch(request.Items)
+				}
+				if err != nil {
+					log.Fatalln("An error occurred running the batch:", err)
+				}
+			}
+
+			// A non-zero exit code lets scripts tell when any of the items failed
+			if failed := printBatchResponse(request.Items, batchResponse, output); failed > 0 {
+				os.Exit(1)
+			}
+		},
+	},
+	{
+		Name:  "deadletter",
+		Usage: "Inspect and replay async batch item messages that couldn't be processed",
+		Subcommands: []cli.Command{
+			{
+				Name:  "list",
+				Usage: "List the dead lettered messages, oldest first",
+				Flags: []cli.Flag{
+					cli.IntFlag{
+						Name:  "offset",
+						Usage: "The number of dead letters to skip",
+						Value: 0,
+					},
+					cli.IntFlag{
+						Name:  "limit, l",
+						Usage: "The max number of dead letters to list",
+						Value: 100,
+					},
+				},
+				Action: func(c *cli.Context) {
+					deadLetters, total, err := model.ListDeadLetters(int64(c.Int("offset")), int64(c.Int("limit")))
+					if err != nil {
+						log.Fatalln("An error occurred listing dead letters:", err)
+					}
+
+					fmt.Printf("%d dead letters\n", total)
+					for _, deadLetter := range deadLetters {
+						fmt.Printf("%s  %s  %-12s attempts: %d  topic: %s  partition: %d  offset: %d  %s\n",
+							deadLetter.ID, deadLetter.Created.Format("2006-01-02T15:04:05"), deadLetter.Reason,
+							deadLetter.Attempts, deadLetter.Topic, deadLetter.Partition, deadLetter.Offset, deadLetter.Error)
+					}
+				},
+			},
+			{
+				Name:  "show",
+				Usage: "Show a dead lettered message. Usage: deadletter show <id>",
+				Action: func(c *cli.Context) {
+					deadLetter, err := model.GetDeadLetter(c.Args().First())
+					if err != nil {
+						log.Fatalln("An error occurred getting dead letter:", err)
+					}
+
+					output, _ := json.MarshalIndent(deadLetter, "", "    ")
+					fmt.Println(string(output))
+				},
+			},
+			{
+				Name:  "replay",
+				Usage: "Send dead lettered messages back to the workers. Usage: deadletter replay <id>... or deadletter replay --reason <reason>",
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "reason",
+						Usage: "Replay every dead letter with this reason, e.g. unknown_version once the workers are upgraded",
+					},
+				},
+				Action: func(c *cli.Context) {
+					ids := []string(c.Args())
+					if reason := c.String("reason"); reason != "" {
+						for offset := int64(0); ; offset += 100 {
+							deadLetters, _, err := model.ListDeadLetters(offset, 100)
+							if err != nil {
+								log.Fatalln("An error occurred listing dead letters:", err)
+							} else if len(deadLetters) == 0 {
+								break
+							}
+
+							for _, deadLetter := range deadLetters {
+								if deadLetter.Reason == reason {
+									ids = append(ids, deadLetter.ID)
+								}
+							}
+						}
+					}
+
+					for _, id := range ids {
+						if err := model.ReplayDeadLetter(id); err != nil {
+							log.Printf("An error occurred replaying dead letter %s: %s", id, err)
+							continue
+						}
+						fmt.Printf("Replayed %s\n", id)
+					}
+					model.CloseAsyncBatchProducer()
+				},
+			},
+		},
+	},
+	{
+		Name:  "jobs",
+		Usage: "Inspect and manage async batch jobs in redis",
+		Subcommands: []cli.Command{
+			{
+				Name:  "list",
+				Usage: "List the async batch jobs, newest first",
+				Flags: jobFilterFlags(
+					cli.IntFlag{
+						Name:  "limit, l",
+						Usage: "The max number of jobs to list. 0 lists them all",
+						Value: 100,
+					},
+					cli.BoolFlag{
+						Name:  "json",
+						Usage: "Print the jobs as JSON instead of a table",
+					},
+				),
+				Action: func(c *cli.Context) {
+					jobs, err := model.ListAsyncJobs(jobFilter(c))
+					if err != nil {
+						log.Fatalln("An error occurred listing async jobs:", err)
+					}
+
+					if limit := c.Int("limit"); limit > 0 && len(jobs) > limit {
+						jobs = jobs[:limit]
+					}
+
+					if c.Bool("json") {
+						printJSON(jobs)
+						return
+					}
+
+					table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+					fmt.Fprintln(table, "REQUEST ID\tIDENTITY\tSTATUS\tCOMPLETED\tPRIORITY\tCREATED")
+					for _, job := range jobs {
+						fmt.Fprintf(table, "%s\t%s\t%s\t%d/%d\t%s\t%s\n",
+							job.RequestID, job.IdentityID, job.Status, job.Completed, job.Total,
+							job.Priority, job.Created.Format("2006-01-02T15:04:05"))
+					}
+					table.Flush()
+				},
+			},
+			{
+				Name:  "show",
+				Usage: "Show an async batch job. Usage: jobs show <request id>",
+				Flags: []cli.Flag{
+					cli.BoolFlag{
+						Name:  "json",
+						Usage: "Print the job as JSON instead of a table",
+					},
+				},
+				Action: func(c *cli.Context) {
+					job, err := model.GetAsyncJobDetail(c.Args().First())
+					if err != nil {
+						log.Fatalln("An error occurred getting async job:", err)
+					}
+
+					if c.Bool("json") {
+						printJSON(job)
+						return
+					}
+
+					table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+					fmt.Fprintf(table, "Request ID:\t%s\n", job.RequestID)
+					fmt.Fprintf(table, "Identity:\t%s\n", job.IdentityID)
+					fmt.Fprintf(table, "Status:\t%s\n", job.Status)
+					if job.Error != "" {
+						fmt.Fprintf(table, "Error:\t%s\n", job.Error)
+					}
+					fmt.Fprintf(table, "Completed:\t%d/%d\n", job.Completed, job.Total)
+					fmt.Fprintf(table, "Pending:\t%d\n", job.Pending)
+					fmt.Fprintf(table, "Takeovers:\t%d\n", job.Takeovers)
+					fmt.Fprintf(table, "Priority:\t%s\n", job.Priority)
+					fmt.Fprintf(table, "Ordering:\t%s\n", job.Ordering)
+					fmt.Fprintf(table, "Created:\t%s\n", job.Created.Format(time.RFC3339))
+					if !job.RunAt.IsZero() {
+						fmt.Fprintf(table, "Run At:\t%s\n", job.RunAt.Format(time.RFC3339))
+					}
+					if job.CompletedAt != nil {
+						fmt.Fprintf(table, "Completed At:\t%s\n", job.CompletedAt.Format(time.RFC3339))
+					}
+					if job.CallbackURL != "" {
+						fmt.Fprintf(table, "Callback:\t%s (%s, %d attempts)\n", job.CallbackURL, job.CallbackStatus, job.CallbackAttempts)
+					}
+					table.Flush()
+				},
+			},
+			{
+				Name:  "cancel",
+				Usage: "Cancel async batch jobs. Usage: jobs cancel <request id>...",
+				Action: func(c *cli.Context) {
+					for _, requestID := range c.Args() {
+						if err := model.CancelAnyAsyncJob(requestID); err != nil {
+							log.Printf("An error occurred cancelling async job %s: %s", requestID, err)
+							continue
+						}
+						fmt.Printf("Cancelled %s\n", requestID)
+					}
+				},
+			},
+			{
+				Name:  "retry",
+				Usage: "Send the items of stuck or failed async batch jobs that don't have a result to the workers again. Usage: jobs retry <request id>...",
+				Action: func(c *cli.Context) {
+					for _, requestID := range c.Args() {
+						sent, err := model.RetryAsyncJob(requestID)
+						if err != nil {
+							log.Printf("An error occurred retrying async job %s: %s", requestID, err)
+							continue
+						}
+						fmt.Printf("Retried %s (%d items)\n", requestID, sent)
+					}
+					model.CloseAsyncBatchProducer()
+				},
+			},
+			{
+				Name:  "purge",
+				Usage: "Delete async batch jobs and their results. Usage: jobs purge <request id>... or jobs purge with filters",
+				Flags: jobFilterFlags(),
+				Action: func(c *cli.Context) {
+					requestIDs := []string(c.Args())
+					filter := jobFilter(c)
+					if filter != (model.AsyncJobFilter{}) {
+						jobs, err := model.ListAsyncJobs(filter)
+						if err != nil {
+							log.Fatalln("An error occurred listing async jobs:", err)
+						}
+						for _, job := range jobs {
+							requestIDs = append(requestIDs, job.RequestID)
+						}
+					} else if len(requestIDs) == 0 {
+						log.Fatalln("Either request IDs or a filter is required, so every job isn't purged by mistake")
+					}
+
+					for _, requestID := range requestIDs {
+						if err := model.PurgeAsyncJob(requestID); err != nil {
+							log.Printf("An error occurred purging async job %s: %s", requestID, err)
+							continue
+						}
+						fmt.Printf("Purged %s\n", requestID)
+					}
+				},
+			},
+		},
+	},
+}
+
+// Get the flags used to filter async batch jobs, along with any extra flags for the command
+func jobFilterFlags(extra ...cli.Flag) []cli.Flag {
+	return append([]cli.Flag{
+		cli.StringFlag{
+			Name:  "identity",
+			Usage: "Only jobs for this identity ID",
+		},
+		cli.StringFlag{
+			Name:  "status",
+			Usage: "Only jobs with this status: scheduled, pending, complete, cancelled or failed",
+		},
+		cli.DurationFlag{
+			Name:  "older-than",
+			Usage: "Only jobs created longer ago than this, e.g. 24h",
+		},
+		cli.DurationFlag{
+			Name:  "newer-than",
+			Usage: "Only jobs created more recently than this, e.g. 30m",
+		},
+	}, extra...)
+}
+
+// Get the async batch job filter from the filter flags
+func jobFilter(c *cli.Context) model.AsyncJobFilter {
+	return model.AsyncJobFilter{
+		IdentityID: c.String("identity"),
+		Status:     c.String("status"),
+		OlderThan:  c.Duration("older-than"),
+		NewerThan:  c.Duration("newer-than"),
+	}
+}
+
+// Prints the value as indented JSON
+func printJSON(value interface{}) {
+	output, _ := json.MarshalIndent(value, "", "    ")
+	fmt.Println(string(output))
 }
@@ -0,0 +1,237 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/johnnadratowski/batch/app/model"
+)
+
+// The output formats of the run command
+const (
+	OutputJSON   = "json"
+	OutputNDJSON = "ndjson"
+	OutputTable  = "table"
+)
+
+// Reads a batch definition from a file, or from stdin if the path is empty or "-".  The
+// definition can be JSON or YAML, and takes either form of the async batch request body.
+func readBatchDefinition(path string) (model.AsyncBatchRequest, error) {
+	var data []byte
+	var err error
+	if path == "" || path == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		return model.AsyncBatchRequest{}, err
+	}
+
+	if !json.Valid(data) {
+		var definition interface{}
+		if err := yaml.Unmarshal(data, &definition); err != nil {
+			return model.AsyncBatchRequest{}, fmt.Errorf("The batch definition isn't valid JSON or YAML: %s", err)
+		}
+		data, err = json.Marshal(yamlToJSON(definition))
+		if err != nil {
+			return model.AsyncBatchRequest{}, fmt.Errorf("The batch definition can't be converted to JSON: %s", err)
+		}
+	}
+
+	var request model.AsyncBatchRequest
+	if err := json.Unmarshal(data, &request); err != nil {
+		return model.AsyncBatchRequest{}, fmt.Errorf("The batch definition isn't a batch: %s", err)
+	} else if len(request.Items) == 0 {
+		return model.AsyncBatchRequest{}, fmt.Errorf("The batch definition has no batch items")
+	}
+	return request, nil
+}
+
+// Converts the maps read from YAML, which can have keys of any type, to maps that can be written as JSON
+func yamlToJSON(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			converted[fmt.Sprint(key)] = yamlToJSON(item)
+		}
+		return converted
+	case []interface{}:
+		for idx, item := range value {
+			value[idx] = yamlToJSON(item)
+		}
+	}
+	return value
+}
+
+// A client for a remote batch server
+type batchServerClient struct {
+	Server  string
+	Headers map[string]string
+	Client  *http.Client
+}
+
+// Get a client for the batch server, sending the headers given as "Name: value" with every request
+func newBatchServerClient(server string, headers []string) (*batchServerClient, error) {
+	client := &batchServerClient{
+		Server:  strings.TrimRight(server, "/"),
+		Headers: map[string]string{},
+		Client:  &http.Client{Timeout: 5 * time.Minute},
+	}
+	for _, header := range headers {
+		parts := strings.SplitN(header, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid header, expected \"Name: value\": %s", header)
+		}
+		client.Headers[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return client, nil
+}
+
+// Sends a request to the batch server.  The server responds to errors with a plain text message,
+// so any response that isn't JSON is returned as an error.
+func (client *batchServerClient) do(method, path string, body interface{}, result interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		output, _ := json.Marshal(body)
+		reader = bytes.NewReader(output)
+	}
+
+	request, err := http.NewRequest(method, client.Server+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for name, value := range client.Headers {
+		request.Header.Set(name, value)
+	}
+
+	response, err := client.Client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	} else if response.StatusCode >= 400 {
+		return nil, fmt.Errorf("The batch server responded with %d: %s", response.StatusCode, bytes.TrimSpace(data))
+	}
+
+	if result != nil && len(bytes.TrimSpace(data)) > 0 {
+		if err := json.Unmarshal(data, result); err != nil {
+			return nil, fmt.Errorf("%s", bytes.TrimSpace(data))
+		}
+	}
+	return response, nil
+}
+
+// Runs the batch items on the batch server, and waits for the responses
+func (client *batchServerClient) RunBatch(batchItems model.BatchItems) (model.BatchResponse, error) {
+	var batchResponse model.BatchResponse
+	if _, err := client.do("POST", "/batch", batchItems, &batchResponse); err != nil {
+		return nil, err
+	}
+	return batchResponse, nil
+}
+
+// Submits the async batch request to the batch server, then polls its status every interval until
+// it's done.  Returns an error if the request was cancelled or failed, or timeout passes first.
+func (client *batchServerClient) RunBatchAsync(ctx context.Context, request model.AsyncBatchRequest, interval time.Duration) (model.BatchResponse, error) {
+	response, err := client.do("POST", "/batch/async", request, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	location := response.Header.Get("Location")
+	if location == "" {
+		return nil, fmt.Errorf("The batch server didn't respond with the location of the async batch request")
+	}
+	fmt.Fprintf(os.Stderr, "Submitted %s\n", location)
+
+	for {
+		var job model.AsyncJob
+		if _, err := client.do("GET", location+"/status", nil, &job); err != nil {
+			return nil, err
+		}
+
+		switch job.Status {
+		case model.AsyncJobComplete:
+			var batchResponse model.BatchResponse
+			if _, err := client.do("GET", location, nil, &batchResponse); err != nil {
+				return nil, err
+			}
+			return batchResponse, nil
+		case model.AsyncJobCancelled, model.AsyncJobFailed:
+			return nil, fmt.Errorf("The async batch request %s is %s. %s", job.RequestID, job.Status, job.Error)
+		}
+
+		fmt.Fprintf(os.Stderr, "%s %s: %d/%d\n", job.RequestID, job.Status, job.Completed, job.Total)
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("Timed out waiting for the async batch request %s", job.RequestID)
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Checks that the output format is one the run command can print
+func validOutput(format string) bool {
+	switch format {
+	case OutputJSON, OutputNDJSON, OutputTable:
+		return true
+	}
+	return false
+}
+
+// Checks whether a batch item response counts as a failure
+func itemFailed(item model.BatchResponseItem) bool {
+	return item.Code == 0 || item.Code >= 400
+}
+
+// Prints the batch responses in the output format.  Returns the number of items that failed.
+func printBatchResponse(batchItems model.BatchItems, batchResponse model.BatchResponse, format string) int {
+	failed := 0
+	for _, item := range batchResponse {
+		if itemFailed(item) {
+			failed++
+		}
+	}
+
+	switch format {
+	case OutputJSON:
+		printJSON(batchResponse)
+	case OutputNDJSON:
+		encoder := json.NewEncoder(os.Stdout)
+		for idx := range batchResponse {
+			encoder.Encode(model.AsyncResponsePageItem{Index: int64(idx), Complete: true, Response: &batchResponse[idx]})
+		}
+	case OutputTable:
+		table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(table, "IDX\tCODE\tMETHOD\tURL")
+		for idx, item := range batchResponse {
+			var batchItem model.BatchItem
+			if idx < len(batchItems) {
+				batchItem = batchItems[idx]
+			}
+			fmt.Fprintf(table, "%d\t%d\t%s\t%s\n", idx, item.Code, batchItem.Method, batchItem.URL)
+		}
+		table.Flush()
+		fmt.Printf("%d items, %d succeeded, %d failed\n", len(batchResponse), len(batchResponse)-failed, failed)
+	}
+
+	return failed
+}
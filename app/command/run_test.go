@@ -0,0 +1,59 @@
+package command
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadBatchDefinition(t *testing.T) {
+	tests := []struct {
+		name       string
+		definition string
+		items      int
+		callback   string
+		valid      bool
+	}{
+		{"json items", `[{"method":"GET","url":"https://example.com/"}]`, 1, "", true},
+		{"json request", `{"callbackUrl":"https://hooks.example.com/","items":[{"method":"GET","url":"/a"},{"method":"GET","url":"/b"}]}`, 2, "https://hooks.example.com/", true},
+		{"yaml items", "- method: GET\n  url: https://example.com/\n  headers:\n    Accept: application/json\n", 1, "", true},
+		{"yaml request", "callbackUrl: https://hooks.example.com/\nitems:\n  - method: POST\n    url: /a\n    body:\n      1: one\n", 1, "https://hooks.example.com/", true},
+		{"no items", `[]`, 0, "", false},
+		{"not a batch", `"batch"`, 0, "", false},
+		{"not json or yaml", "items: [", 0, "", false},
+	}
+
+	dir := t.TempDir()
+	for idx, test := range tests {
+		path := filepath.Join(dir, string(rune('a'+idx)))
+		if err := ioutil.WriteFile(path, []byte(test.definition), 0644); err != nil {
+			t.Fatalf("Unable to write the definition: %s", err)
+		}
+
+		request, err := readBatchDefinition(path)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: valid %t, expected %t (error: %v)", test.name, err == nil, test.valid, err)
+		} else if len(request.Items) != test.items || request.CallbackURL != test.callback {
+			t.Errorf("%s: got %d items and callback %q, expected %d and %q", test.name, len(request.Items), request.CallbackURL, test.items, test.callback)
+		}
+	}
+
+	if _, err := readBatchDefinition(filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("Expected a missing file to fail")
+	}
+}
+
+func TestNewBatchServerClient(t *testing.T) {
+	client, err := newBatchServerClient("http://localhost:8087/", []string{"Authorization: Bearer token", "X-Identity:  identity "})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	} else if client.Server != "http://localhost:8087" {
+		t.Errorf("Expected the trailing slash to be trimmed, got %q", client.Server)
+	} else if client.Headers["Authorization"] != "Bearer token" || client.Headers["X-Identity"] != "identity" {
+		t.Errorf("Got headers %v", client.Headers)
+	}
+
+	if _, err := newBatchServerClient("http://localhost:8087", []string{"no colon"}); err == nil {
+		t.Errorf("Expected a header without a colon to be invalid")
+	}
+}
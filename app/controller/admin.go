@@ -0,0 +1,69 @@
+package controller
+
+import (
+	"github.com/gocraft/web"
+
+	"expvar"
+	"fmt"
+	"strconv"
+
+	"github.com/johnnadratowski/batch/app/context"
+	"github.com/johnnadratowski/batch/app/model"
+)
+
+// The response for listing dead letters
+type deadLetterList struct {
+	Total       int64              `json:"total"`
+	DeadLetters []model.DeadLetter `json:"deadLetters"`
+}
+
+// DeadLetterList lists the async batch item messages that couldn't be processed
+func DeadLetterList(c *context.Context, rw web.ResponseWriter, req *web.Request) {
+	query, _, err := parseAsyncResponseQuery(req)
+	if err != nil {
+		fmt.Fprint(rw, err)
+		return
+	}
+
+	limit := query.Limit
+	if limit == 0 {
+		limit = model.ASYNC_PAGE_LIMIT
+	} else if limit > model.ASYNC_PAGE_MAX_LIMIT {
+		limit = model.ASYNC_PAGE_MAX_LIMIT
+	}
+
+	deadLetters, total, err := model.ListDeadLetters(query.Offset, limit)
+	if err != nil {
+		fmt.Fprint(rw, err)
+		return
+	}
+
+	rw.Header().Set("X-Total-Count", strconv.FormatInt(total, 10))
+	writeJSON(rw, deadLetterList{Total: total, DeadLetters: deadLetters})
+}
+
+// DeadLetterRetrieve retrieves a single dead lettered message
+func DeadLetterRetrieve(c *context.Context, rw web.ResponseWriter, req *web.Request) {
+	deadLetter, err := model.GetDeadLetter(req.PathParams["deadLetterID"])
+	if err != nil {
+		fmt.Fprint(rw, err)
+		return
+	}
+
+	writeJSON(rw, deadLetter)
+}
+
+// DeadLetterReplay sends a dead lettered message back to the workers
+func DeadLetterReplay(c *context.Context, rw web.ResponseWriter, req *web.Request) {
+	if err := model.ReplayDeadLetter(req.PathParams["deadLetterID"]); err != nil {
+		fmt.Fprint(rw, err)
+		return
+	}
+
+	rw.WriteHeader(202)
+}
+
+// Vars writes the expvar metrics, including the lag and concurrency of the async workers
+func Vars(c *context.Context, rw web.ResponseWriter, req *web.Request) {
+	expvar.Handler().ServeHTTP(rw, req.Request)
+}
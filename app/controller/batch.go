@@ -5,7 +5,10 @@ import (
 
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
+	"strconv"
 
 	"github.com/johnnadratowski/batch/app/context"
 	"github.com/johnnadratowski/batch/app/model"
@@ -33,7 +36,8 @@ func Batch(c *context.Context, rw web.ResponseWriter, req *web.Request) {
 		return
 	}
 
-	batchResponse := batchItems.RunBatch(c.IdentityID)
+	model.ObserveBatchSize("sync", len(batchItems))
+	batchResponse := batchItems.RunBatch(req.Context(), c.IdentityID)
 
 	err := json.NewEncoder(rw).Encode(batchResponse)
 	if err != nil {
@@ -41,40 +45,100 @@ func Batch(c *context.Context, rw web.ResponseWriter, req *web.Request) {
 		fmt.Fprint(rw, "An internal server error occurred")
 		return
 	}
+	keepIdempotentResponse(rw)
 }
 
 // AsyncBatch processes batch requests asynchronously
 func AsyncBatch(c *context.Context, rw web.ResponseWriter, req *web.Request) {
-	var batchItems model.BatchItems
-	if err := json.NewDecoder(req.Body).Decode(&batchItems); err != nil {
+	var asyncRequest model.AsyncBatchRequest
+	if err := json.NewDecoder(req.Body).Decode(&asyncRequest); err != nil {
 		err := fmt.Errorf("Unable to parse JSON")
 		fmt.Fprint(rw, err)
 		return
 	}
 
-	if len(batchItems) > MAX_REQUESTS_ASYNC {
-		err := fmt.Errorf("Too many async batch requests at once. Max allowed: %d Sent: %d", MAX_REQUESTS, len(batchItems))
-		fmt.Fprint(rw, err)
-		return
-	} else if len(batchItems) == 0 {
-		err := fmt.Errorf("No batch items recieved")
+	if err := validateAsyncBatchRequest(asyncRequest); err != nil {
 		fmt.Fprint(rw, err)
 		return
 	}
 
-	requestID, err := batchItems.RunBatchAsync(c.IdentityID)
+	model.ObserveBatchSize("async", len(asyncRequest.Items))
+	requestID, err := asyncRequest.Items.RunBatchAsync(req.Context(), c.IdentityID, asyncRequest.AsyncBatchOptions)
 	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprint(rw, err)
 		return
 	}
 
 	rw.Header().Set("LOCATION", "/batch/async/"+requestID)
 	rw.WriteHeader(202)
+	keepIdempotentResponse(rw)
+}
+
+// validateAsyncBatchRequest checks the items and options of an async batch request
+func validateAsyncBatchRequest(asyncRequest model.AsyncBatchRequest) error {
+	batchItems := asyncRequest.Items
+	if len(batchItems) > MAX_REQUESTS_ASYNC {
+		return fmt.Errorf("Too many async batch requests at once. Max allowed: %d Sent: %d", MAX_REQUESTS, len(batchItems))
+	} else if len(batchItems) == 0 {
+		return fmt.Errorf("No batch items recieved")
+	}
+
+	if callbackURL := asyncRequest.CallbackURL; callbackURL != "" {
+		if err := model.ValidateCallbackURL(callbackURL); err != nil {
+			return err
+		}
+	}
+
+	if !model.ValidPriority(asyncRequest.Priority) {
+		return fmt.Errorf("Invalid priority: %s", asyncRequest.Priority)
+	}
+
+	if !model.ValidOrdering(asyncRequest.Ordering) {
+		return fmt.Errorf("Invalid ordering: %s", asyncRequest.Ordering)
+	} else if asyncRequest.Ordering == model.OrderingPerResource {
+		for idx, batchItem := range batchItems {
+			if batchItem.OrderingKey == "" {
+				return fmt.Errorf("Batch item %d is missing an orderingKey, which is required with per-resource ordering", idx)
+			}
+		}
+	}
+
+	if asyncRequest.RunAt != nil && asyncRequest.DelaySeconds != 0 {
+		return fmt.Errorf("Only one of runAt and delaySeconds can be sent")
+	} else if asyncRequest.DelaySeconds < 0 {
+		return fmt.Errorf("Invalid delaySeconds: %d", asyncRequest.DelaySeconds)
+	}
+
+	if resultTTL := asyncRequest.ResultTTL; resultTTL != 0 && (resultTTL < model.ASYNC_RESULT_TTL_MIN || resultTTL > model.ASYNC_RESULT_TTL_MAX) {
+		return fmt.Errorf("Invalid resultTtl: %d. Must be between %d and %d seconds", resultTTL, model.ASYNC_RESULT_TTL_MIN, model.ASYNC_RESULT_TTL_MAX)
+	}
+
+	return nil
 }
 
 // AsyncBatchRetrieve retrieves an asynchronous batch requests data
 func AsyncBatchRetrieve(c *context.Context, rw web.ResponseWriter, req *web.Request) {
 	requestID := req.PathParams["requestID"]
+
+	query, paged, err := parseAsyncResponseQuery(req)
+	if err != nil {
+		fmt.Fprint(rw, err)
+		return
+	}
+
+	if query.Extend {
+		if err := model.ExtendAsyncJob(c.IdentityID, requestID); err != nil {
+			fmt.Fprint(rw, err)
+			return
+		}
+	}
+
+	if paged {
+		asyncBatchRetrievePage(rw, requestID, query)
+		return
+	}
+
 	batchResponse, err := model.RetrieveAsyncResponse(requestID)
 	if err != nil {
 		fmt.Fprint(rw, err)
@@ -91,3 +155,145 @@ func AsyncBatchRetrieve(c *context.Context, rw web.ResponseWriter, req *web.Requ
 		}
 	}
 }
+
+// AsyncBatchStatus retrieves the status of an asynchronous batch request
+func AsyncBatchStatus(c *context.Context, rw web.ResponseWriter, req *web.Request) {
+	requestID := req.PathParams["requestID"]
+
+	redis := model.GetAsyncJobRedis()
+	defer redis.Close()
+
+	job, err := model.GetIdentityAsyncJob(redis, c.IdentityID, requestID)
+	if err != nil {
+		fmt.Fprint(rw, err)
+		return
+	}
+
+	err = json.NewEncoder(rw).Encode(job)
+	if err != nil {
+		log.Printf("An error occurred writing response: %s", err)
+		fmt.Fprint(rw, "An internal server error occurred")
+		return
+	}
+}
+
+// AsyncBatchCancel cancels an asynchronous batch request
+func AsyncBatchCancel(c *context.Context, rw web.ResponseWriter, req *web.Request) {
+	requestID := req.PathParams["requestID"]
+	if err := model.CancelAsyncJob(c.IdentityID, requestID); err != nil {
+		fmt.Fprint(rw, err)
+		return
+	}
+
+	rw.WriteHeader(204)
+}
+
+// AsyncBatchRetry sends the failed items of a completed asynchronous batch request to the workers again
+func AsyncBatchRetry(c *context.Context, rw web.ResponseWriter, req *web.Request) {
+	requestID := req.PathParams["requestID"]
+
+	// The body is optional, and only narrows down which failed items are retried
+	var retryRequest model.AsyncRetryRequest
+	if err := json.NewDecoder(req.Body).Decode(&retryRequest); err != nil && err != io.EOF {
+		err := fmt.Errorf("Unable to parse JSON")
+		fmt.Fprint(rw, err)
+		return
+	}
+
+	retry, err := model.RetryAsyncJobItems(c.IdentityID, requestID, retryRequest)
+	if err != nil {
+		fmt.Fprint(rw, err)
+		return
+	}
+
+	if retry.Retried > 0 {
+		rw.Header().Set("LOCATION", "/batch/async/"+requestID)
+		rw.WriteHeader(202)
+	}
+
+	err = json.NewEncoder(rw).Encode(retry)
+	if err != nil {
+		log.Printf("An error occurred writing response: %s", err)
+		fmt.Fprint(rw, "An internal server error occurred")
+		return
+	}
+}
+
+// AsyncBatchItemBody downloads the response body of a single item of an asynchronous batch request
+func AsyncBatchItemBody(c *context.Context, rw web.ResponseWriter, req *web.Request) {
+	requestID := req.PathParams["requestID"]
+	index, err := strconv.ParseInt(req.PathParams["index"], 10, 64)
+	if err != nil || index < 0 {
+		fmt.Fprint(rw, fmt.Errorf("Invalid index: %s", req.PathParams["index"]))
+		return
+	}
+
+	body, err := model.RetrieveAsyncItemBody(c.IdentityID, requestID, index)
+	if err != nil {
+		fmt.Fprint(rw, err)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(body)
+}
+
+// asyncBatchRetrievePage writes a single page of an asynchronous batch requests data
+func asyncBatchRetrievePage(rw web.ResponseWriter, requestID string, query model.AsyncResponseQuery) {
+	page, err := model.RetrieveAsyncResponsePage(requestID, query)
+	if err != nil {
+		fmt.Fprint(rw, err)
+		return
+	}
+
+	err = json.NewEncoder(rw).Encode(page)
+	if err != nil {
+		log.Printf("An error occurred writing response: %s", err)
+		fmt.Fprint(rw, "An internal server error occurred")
+		return
+	}
+}
+
+// parseAsyncResponseQuery gets the paging options from the query string.  paged is false if none were sent.
+func parseAsyncResponseQuery(req *web.Request) (query model.AsyncResponseQuery, paged bool, err error) {
+	values := req.URL.Query()
+
+	if offset := values.Get("offset"); offset != "" {
+		paged = true
+		query.Offset, err = strconv.ParseInt(offset, 10, 64)
+		if err != nil || query.Offset < 0 {
+			return query, paged, fmt.Errorf("Invalid offset: %s", offset)
+		}
+	}
+
+	if limit := values.Get("limit"); limit != "" {
+		paged = true
+		query.Limit, err = strconv.ParseInt(limit, 10, 64)
+		if err != nil || query.Limit <= 0 {
+			return query, paged, fmt.Errorf("Invalid limit: %s", limit)
+		}
+	}
+
+	if completedOnly := values.Get("completedOnly"); completedOnly != "" {
+		paged = true
+		query.CompletedOnly, err = strconv.ParseBool(completedOnly)
+		if err != nil {
+			return query, paged, fmt.Errorf("Invalid completedOnly: %s", completedOnly)
+		}
+	}
+
+	if cursor := values.Get("cursor"); cursor != "" {
+		paged = true
+		query.Cursor = cursor
+	}
+
+	// Extending works the same for paged and unpaged responses
+	if extend := values.Get("extend"); extend != "" {
+		query.Extend, err = strconv.ParseBool(extend)
+		if err != nil {
+			return query, paged, fmt.Errorf("Invalid extend: %s", extend)
+		}
+	}
+
+	return query, paged, nil
+}
@@ -0,0 +1,116 @@
+package controller
+
+import (
+	"github.com/gocraft/web"
+
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/johnnadratowski/batch/app/context"
+	"github.com/johnnadratowski/batch/app/model"
+)
+
+// The requests that can be sent with an Idempotency-Key.  These start batches, so sending one twice
+// would run its items twice.
+var idempotentPaths = map[string]bool{
+	"/batch":       true,
+	"/batch/async": true,
+}
+
+// recordingResponseWriter keeps a copy of the response so it can be saved for an idempotency key
+type recordingResponseWriter struct {
+	web.ResponseWriter
+	status int
+	body   bytes.Buffer
+	keep   bool
+}
+
+func (rw *recordingResponseWriter) WriteHeader(status int) {
+	rw.status = status
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *recordingResponseWriter) Write(data []byte) (int, error) {
+	rw.body.Write(data)
+	return rw.ResponseWriter.Write(data)
+}
+
+// keepIdempotentResponse marks the response as the outcome of the request, to be returned for any
+// duplicate sent with the same Idempotency-Key.  Responses that aren't marked, like a request that
+// failed validation, release the key so the request can be fixed and sent again.
+func keepIdempotentResponse(rw web.ResponseWriter) {
+	if recorder, ok := rw.(*recordingResponseWriter); ok {
+		recorder.keep = true
+	}
+}
+
+// Idempotency makes the POST requests that start batches safe to retry when they're sent with an
+// Idempotency-Key header.  The first successful response for a key is saved, and returned for any
+// duplicate of that request.
+func Idempotency(c *context.Context, rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	key := req.Header.Get("Idempotency-Key")
+	if key == "" || req.Method != "POST" || !idempotentPaths[req.URL.Path] {
+		next(rw, req)
+		return
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		err := fmt.Errorf("Unable to read request")
+		fmt.Fprint(rw, err)
+		return
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	requestHash := model.HashIdempotentRequest(req.Method, req.URL.Path, body)
+	response, err := model.StartIdempotentRequest(c.IdentityID, key, requestHash)
+	if err == model.ErrIdempotencyConflict {
+		rw.WriteHeader(http.StatusConflict)
+		fmt.Fprint(rw, err)
+		return
+	} else if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(rw, err)
+		return
+	} else if response != nil {
+		for header, val := range response.Headers {
+			rw.Header().Set(header, val)
+		}
+		rw.Header().Set("Idempotent-Replayed", "true")
+		rw.WriteHeader(response.Status)
+		fmt.Fprint(rw, response.Body)
+		return
+	}
+
+	// The key is held for as long as the request is processed, however long the batch takes
+	done := make(chan bool)
+	go model.KeepIdempotentRequest(c.IdentityID, key, requestHash, done)
+	recorder := &recordingResponseWriter{ResponseWriter: rw, status: http.StatusOK}
+	next(recorder, req)
+	close(done)
+
+	// Failed requests aren't saved, so the client can retry them with the same key
+	if !recorder.keep || recorder.status >= 500 {
+		model.AbortIdempotentRequest(c.IdentityID, key)
+		return
+	}
+
+	headers := map[string]string{}
+	for header := range rw.Header() {
+		headers[header] = rw.Header().Get(header)
+	}
+
+	err = model.FinishIdempotentRequest(c.IdentityID, key, model.IdempotentResponse{
+		RequestHash: requestHash,
+		Status:      recorder.status,
+		Headers:     headers,
+		Body:        recorder.body.String(),
+	})
+	if err != nil {
+		log.Printf("An error occurred saving the response for idempotency key %s. Releasing it: %s", key, err)
+		model.AbortIdempotentRequest(c.IdentityID, key)
+	}
+}
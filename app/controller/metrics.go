@@ -0,0 +1,35 @@
+package controller
+
+import (
+	"github.com/gocraft/web"
+
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/johnnadratowski/batch/app/context"
+	"github.com/johnnadratowski/batch/app/model"
+)
+
+// RequestMetrics records the count and latency of every request, by the route it matched
+func RequestMetrics(c *context.Context, rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	start := time.Now()
+	next(rw, req)
+
+	// Routes are labelled by their path pattern, so request IDs don't each get their own label
+	route := "unmatched"
+	if req.IsRouted() {
+		route = req.RoutePath()
+	}
+
+	code := rw.StatusCode()
+	if code == 0 {
+		code = 200
+	}
+	model.ObserveHTTPRequest(route, req.Method, code, time.Since(start))
+}
+
+// Metrics writes the prometheus metrics
+func Metrics(c *context.Context, rw web.ResponseWriter, req *web.Request) {
+	promhttp.Handler().ServeHTTP(rw, req.Request)
+}
@@ -0,0 +1,112 @@
+package controller
+
+import (
+	"github.com/gocraft/web"
+
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/johnnadratowski/batch/app/context"
+	"github.com/johnnadratowski/batch/app/model"
+)
+
+// The body for creating or updating a batch schedule
+type scheduleRequest struct {
+	Cron  string                  `json:"cron"`
+	Batch model.AsyncBatchRequest `json:"batch"`
+}
+
+// parseScheduleRequest reads and validates the body for creating or updating a batch schedule
+func parseScheduleRequest(req *web.Request) (scheduleRequest, error) {
+	var body scheduleRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return body, fmt.Errorf("Unable to parse JSON")
+	}
+
+	if body.Cron == "" {
+		return body, fmt.Errorf("No cron expression recieved")
+	} else if body.Batch.RunAt != nil || body.Batch.DelaySeconds != 0 {
+		return body, fmt.Errorf("runAt and delaySeconds can not be used with a batch schedule")
+	}
+
+	return body, validateAsyncBatchRequest(body.Batch)
+}
+
+// writeJSON writes the value as the JSON response
+func writeJSON(rw web.ResponseWriter, value interface{}) {
+	err := json.NewEncoder(rw).Encode(value)
+	if err != nil {
+		log.Printf("An error occurred writing response: %s", err)
+		fmt.Fprint(rw, "An internal server error occurred")
+		return
+	}
+}
+
+// ScheduleCreate creates a recurring batch schedule
+func ScheduleCreate(c *context.Context, rw web.ResponseWriter, req *web.Request) {
+	body, err := parseScheduleRequest(req)
+	if err != nil {
+		fmt.Fprint(rw, err)
+		return
+	}
+
+	schedule, err := model.CreateBatchSchedule(c.IdentityID, body.Cron, body.Batch)
+	if err != nil {
+		fmt.Fprint(rw, err)
+		return
+	}
+
+	rw.Header().Set("LOCATION", "/batch/schedules/"+schedule.ID)
+	rw.WriteHeader(201)
+	writeJSON(rw, schedule)
+}
+
+// ScheduleList lists the recurring batch schedules
+func ScheduleList(c *context.Context, rw web.ResponseWriter, req *web.Request) {
+	schedules, err := model.ListBatchSchedules(c.IdentityID)
+	if err != nil {
+		fmt.Fprint(rw, err)
+		return
+	}
+
+	writeJSON(rw, schedules)
+}
+
+// ScheduleRetrieve retrieves a recurring batch schedule, with its recent runs
+func ScheduleRetrieve(c *context.Context, rw web.ResponseWriter, req *web.Request) {
+	schedule, err := model.GetBatchSchedule(c.IdentityID, req.PathParams["scheduleID"])
+	if err != nil {
+		fmt.Fprint(rw, err)
+		return
+	}
+
+	writeJSON(rw, schedule)
+}
+
+// ScheduleUpdate replaces the cron expression and batch of a recurring batch schedule
+func ScheduleUpdate(c *context.Context, rw web.ResponseWriter, req *web.Request) {
+	body, err := parseScheduleRequest(req)
+	if err != nil {
+		fmt.Fprint(rw, err)
+		return
+	}
+
+	schedule, err := model.UpdateBatchSchedule(c.IdentityID, req.PathParams["scheduleID"], body.Cron, body.Batch)
+	if err != nil {
+		fmt.Fprint(rw, err)
+		return
+	}
+
+	writeJSON(rw, schedule)
+}
+
+// ScheduleDelete deletes a recurring batch schedule
+func ScheduleDelete(c *context.Context, rw web.ResponseWriter, req *web.Request) {
+	if err := model.DeleteBatchSchedule(c.IdentityID, req.PathParams["scheduleID"]); err != nil {
+		fmt.Fprint(rw, err)
+		return
+	}
+
+	rw.WriteHeader(204)
+}
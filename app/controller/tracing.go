@@ -0,0 +1,30 @@
+package controller
+
+import (
+	"github.com/gocraft/web"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/johnnadratowski/batch/app/context"
+	"github.com/johnnadratowski/batch/app/model"
+)
+
+// Tracing starts a span for every request, joining the caller's trace if it sent a traceparent header
+func Tracing(c *context.Context, rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	ctx, span := model.StartHTTPSpan(req.Request)
+	defer span.End()
+
+	req.Request = req.Request.WithContext(ctx)
+	next(rw, req)
+
+	// Spans are named by their path pattern, like the request metrics
+	if req.IsRouted() {
+		span.SetName(req.Method + " " + req.RoutePath())
+	}
+
+	code := rw.StatusCode()
+	if code == 0 {
+		code = 200
+	}
+	span.SetAttributes(attribute.Int("http.status_code", code))
+}
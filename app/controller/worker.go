@@ -0,0 +1,51 @@
+package controller
+
+import (
+	"github.com/gocraft/web"
+
+	"fmt"
+	"net/http"
+
+	"github.com/johnnadratowski/batch/app/context"
+	"github.com/johnnadratowski/batch/app/model"
+)
+
+// The response for listing the async workers
+type workerList struct {
+	Health  model.AsyncWorkerHealth  `json:"health"`
+	Workers []model.AsyncWorkerState `json:"workers"`
+}
+
+// Writes OK, or a 503 with the reason the check failed
+func writeCheck(rw web.ResponseWriter, err error) {
+	rw.Header().Set("Content-Type", "text/plain")
+	if err != nil {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(rw, err)
+		return
+	}
+	fmt.Fprint(rw, "OK")
+}
+
+// WorkerLive checks the async workers haven't failed or gotten stuck
+func WorkerLive(c *context.Context, rw web.ResponseWriter, req *web.Request) {
+	writeCheck(rw, model.AsyncWorkersLive())
+}
+
+// WorkerReady checks the async workers are connected to kafka and redis
+func WorkerReady(c *context.Context, rw web.ResponseWriter, req *web.Request) {
+	writeCheck(rw, model.AsyncWorkersReady())
+}
+
+// WorkerList gets what each async worker is doing, and the health of the workers
+func WorkerList(c *context.Context, rw web.ResponseWriter, req *web.Request) {
+	writeJSON(rw, workerList{
+		Health:  model.GetAsyncWorkerHealth(),
+		Workers: model.ListAsyncWorkerStates(),
+	})
+}
+
+// WorkerErrors gets the most recent errors in the async workers
+func WorkerErrors(c *context.Context, rw web.ResponseWriter, req *web.Request) {
+	writeJSON(rw, model.RecentAsyncWorkerErrors())
+}
@@ -1,15 +1,22 @@
 package model
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/wvanbergen/kafka/consumergroup"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"gopkg.in/redis.v2"
 )
 
@@ -20,10 +27,23 @@ var REDIS_DB int = 0
 var ZOOKEEPER string = "default"
 var CONSUMERGROUP string = "default"
 var TOPIC string = "default"
+var TOPIC_HIGH string = "default_high"
+var TOPIC_LOW string = "default_low"
+var WEIGHT_HIGH int = 6
+var WEIGHT_NORMAL int = 3
+var WEIGHT_LOW int = 1
 var HEAD_OFFSETS int64 = 0
 var RESET_OFFSETS bool = false
-var WORKER_SLEEP int = 100
+var WORKER_BUFFER int = 100
+var WORKER_HELD_BUFFER int = 10000
+var DRAIN_TIMEOUT int = 30000
 var ASYNC_EXPIRE int = 1000
+var ASYNC_CANCEL_EXPIRE int = 5
+var ASYNC_SAVE_ITEMS bool = true
+var ASYNC_RESULT_TTL_MIN int64 = 60
+var ASYNC_RESULT_TTL_MAX int64 = 604800
+var ASYNC_PAGE_LIMIT int64 = 100
+var ASYNC_PAGE_MAX_LIMIT int64 = 1000
 
 // Struct used to write to kafka an asynchronous batch item request
 type AsyncBatchItem struct {
@@ -31,6 +51,87 @@ type AsyncBatchItem struct {
 	Index      int64     `json:"idx"`
 	Item       BatchItem `json:"item"`
 	IdentityID string    `json:"identityId"`
+	Sequence   string    `json:"sequence,omitempty"`
+}
+
+// The response saved for the items of an async batch request that was cancelled before they were processed
+var AsyncCancelledResponse = BatchResponseItem{
+	Code: 499,
+	Body: "Cancelled",
+}
+
+// Options for an asynchronous batch request
+type AsyncBatchOptions struct {
+	CallbackURL     string            `json:"callbackUrl"`
+	CallbackHeaders map[string]string `json:"callbackHeaders"`
+	CallbackSecret  string            `json:"callbackSecret"`
+	RunAt           *time.Time        `json:"runAt"`
+	DelaySeconds    int64             `json:"delaySeconds"`
+	Priority        string            `json:"priority"`
+	Ordering        string            `json:"ordering"`
+	ResultTTL       int64             `json:"resultTtl"`
+}
+
+// Get the number of seconds the results are kept after the request completes.  Defaults to ASYNC_EXPIRE.
+func (options AsyncBatchOptions) ResultTTLSeconds() int64 {
+	if options.ResultTTL > 0 {
+		return options.ResultTTL
+	}
+	return int64(ASYNC_EXPIRE) * 60
+}
+
+// Get the time the async batch request should run at.  Zero if it should run right away.
+func (options AsyncBatchOptions) ScheduledFor() time.Time {
+	if options.RunAt != nil {
+		return *options.RunAt
+	} else if options.DelaySeconds > 0 {
+		return time.Now().Add(time.Duration(options.DelaySeconds) * time.Second)
+	}
+	return time.Time{}
+}
+
+// The body of an asynchronous batch request.  Can either be a list of batch
+// items, or an object with the batch items and the options for the request.
+type AsyncBatchRequest struct {
+	AsyncBatchOptions
+	Items BatchItems `json:"items"`
+}
+
+// Reads either form of the asynchronous batch request
+func (asyncRequest *AsyncBatchRequest) UnmarshalJSON(data []byte) error {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		return json.Unmarshal(data, &asyncRequest.Items)
+	}
+
+	type asyncBatchRequest AsyncBatchRequest
+	return json.Unmarshal(data, (*asyncBatchRequest)(asyncRequest))
+}
+
+// Options for retrieving a single page of an async response
+type AsyncResponseQuery struct {
+	Offset        int64
+	Limit         int64
+	CompletedOnly bool
+	Cursor        string
+	Extend        bool
+}
+
+// A single item in a page of an async response
+type AsyncResponsePageItem struct {
+	Index    int64              `json:"idx"`
+	Complete bool               `json:"complete"`
+	Attempts int64              `json:"attempts"`
+	Response *BatchResponseItem `json:"response,omitempty"`
+}
+
+// A page of the items for an async response.  NextCursor is empty when there are no more items.
+type AsyncResponsePage struct {
+	RequestID  string                  `json:"requestId"`
+	Total      int64                   `json:"total"`
+	Offset     int64                   `json:"offset"`
+	Limit      int64                   `json:"limit"`
+	Items      []AsyncResponsePageItem `json:"items"`
+	NextCursor string                  `json:"nextCursor,omitempty"`
 }
 
 // Get a redis instance for the async jobs
@@ -41,138 +142,391 @@ var GetAsyncJobRedis = func() *redis.Client {
 		strconv.Itoa(REDIS_DB))
 }
 
-// Get the kafka producer for asynchronous batch requests
+// Get the kafka producer for asynchronous batch requests.  The producer is shared, so it shouldn't be closed.
 var GetAsyncBatchProducer = func() (sarama.SyncProducer, error) {
-	return NewAsyncBatchProducer(ZOOKEEPER)
+	return sharedAsyncBatchProducer()
 }
 
 // Get the kafka consumer for asynchronous batch requests
-var GetAsyncBatchConsumer = func() (*consumergroup.ConsumerGroup, error) {
+var GetAsyncBatchConsumer = func(priority string) (*consumergroup.ConsumerGroup, error) {
 	return NewAsyncBatchConsumer(ZOOKEEPER,
-		CONSUMERGROUP,
-		TOPIC,
+		PriorityConsumerGroup(priority),
+		PriorityTopic(priority),
 		HEAD_OFFSETS,
 		RESET_OFFSETS)
 }
 
-// Get the client to use for the http requests
+// Get the client to use for the http requests.  Each request times out after ITEM_REQUEST_TIMEOUT.
 var GetRequestClient = func() BatchClient {
-	return &http.Client{}
+	return &http.Client{
+		Timeout: time.Duration(ITEM_REQUEST_TIMEOUT) * time.Second,
+	}
+}
+
+// Get how long shutting down waits for in-flight items to finish before cancelling them
+func DrainTimeout() time.Duration {
+	return time.Duration(DRAIN_TIMEOUT) * time.Millisecond
 }
 
-// Starts a bunch of background worker tasks to process asynchronous batch items from kafka/redis
+// Starts the background tasks to process asynchronous batch items from kafka/redis.  numWorkers
+// is the number of items processed at once to start with, see newWorkerScaler.  On quit the workers stop taking new messages and get
+// DRAIN_TIMEOUT to finish the items they're in the middle of.  Items still running after that are
+// cancelled, and left uncommitted to be redone.
 func StartAsyncWorkers(numWorkers int, quit chan bool, finished chan bool) {
-	quitWorkers := make([]chan bool, numWorkers)
-	finishedWorkers := make([]chan bool, numWorkers)
-	for i := 0; i < numWorkers; i++ {
-		log.Printf("Starting worker: %d", i)
-		quitWorkers[i] = make(chan bool, 1)
-		finishedWorkers[i] = make(chan bool, 1)
-		go StartAsyncWorker(i, quitWorkers[i], finishedWorkers[i])
-	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	log.Printf("Starting %d workers", numWorkers)
+	quitWorker := make(chan bool, 1)
+	finishedWorker := make(chan bool, 1)
+	go StartAsyncWorker(ctx, numWorkers, quitWorker, finishedWorker)
+
+	// Scheduled jobs are sent to the workers by the same process that runs the workers
+	quitScheduler := make(chan bool, 1)
+	finishedScheduler := make(chan bool, 1)
+	go StartAsyncScheduler(quitScheduler, finishedScheduler)
 
 	<-quit
-	go func() {
-		for idx, quitWorker := range quitWorkers {
-			log.Printf("Quitting worker: %d", idx)
-			quitWorker <- true
-		}
-	}()
+	quitScheduler <- true
+	quitWorker <- true
+
+	select {
+	case <-finishedWorker:
+		log.Println("Workers finished successfully.")
+	case <-time.After(DrainTimeout()):
+		log.Printf("Workers did not drain within %s. Cancelling in-flight items.", DrainTimeout())
+		cancel()
 
-	for idx, finishedWorker := range finishedWorkers {
 		select {
 		case <-finishedWorker:
-			log.Printf("Worker %d finished successfully.", idx)
+			log.Println("Workers finished after cancelling their in-flight items.")
 		case <-time.After(1 * time.Second):
-			log.Printf("Worker %d DID NOT finish.", idx)
+			log.Println("Workers DID NOT finish.")
 		}
 	}
 
+	select {
+	case <-finishedScheduler:
+		log.Println("Async scheduler finished successfully.")
+	case <-time.After(1 * time.Second):
+		log.Println("Async scheduler DID NOT finish.")
+	}
+
 	finished <- true
 }
 
-// Starts a new background worker task to process asynchronous batch items from kafka/redis
-func StartAsyncWorker(workerNum int, quit chan bool, finished chan bool) {
-	sleepDuration := time.Duration(WORKER_SLEEP) * time.Millisecond
+// The outcome of a worker processing a message.  Processed is false if it was cancelled.
+type asyncWorkerResult struct {
+	Message   *sarama.ConsumerMessage
+	Processed bool
+}
 
-	// Keep worker alive if it dies
+// Reads asynchronous batch items from kafka and hands them out to a pool of workers until quit.
+// Nothing sleeps, it waits on whichever of reading a message, a worker being free, or a worker
+// finishing happens first.  Offsets are committed in order once every message before them is done.
+// The pool is resized every WORKERS_SCALE_INTERVAL based on the lag of the consumer groups.  The items being processed
+// are cancelled when ctx is done.  Returns an error if it stopped for any reason other than quit.
+// The consumers and workers are always cleaned up before this returns, even if it panics.
+func runAsyncConsumer(ctx context.Context, numWorkers int, quit chan bool) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
-			fmt.Printf("Worker %d died. Restarting in 1 seconds. (error: %s)", workerNum, r)
-			time.Sleep(sleepDuration)
-			StartAsyncWorker(workerNum, quit, finished)
+			err = fmt.Errorf("panic: %v", r)
 		}
 	}()
 
-	redis := GetAsyncJobRedis()
-	consumer, err := GetAsyncBatchConsumer()
-	if err != nil {
-		log.Printf("An error occurred connecting to consumer: %s", err)
+	// Each priority has its own topic and consumer, so the worker can choose which to take from
+	consumers := map[string]*consumergroup.ConsumerGroup{}
+	defer func() {
+		// Closing the consumers flushes the offsets committed for the finished messages
+		log.Println("Closing Consumers")
+		for topic, consumer := range consumers {
+			if err := consumer.Close(); err != nil {
+				sarama.Logger.Printf("Error closing the consumer: [topic: %s] %s", topic, err)
+			}
+		}
+	}()
+
+	messages := map[string]<-chan *sarama.ConsumerMessage{}
+	for _, priority := range AsyncPriorities {
+		consumer, err := GetAsyncBatchConsumer(priority)
+		if err != nil || consumer == nil {
+			log.Printf("An error occurred connecting to consumer: [priority: %s] (error: %s)", priority, err)
+			return fmt.Errorf("Unable to connect to the consumer for priority %s: %s", priority, err)
+		}
+		consumers[PriorityTopic(priority)] = consumer
+		messages[priority] = consumer.Messages()
+	}
+	setAsyncWorkerHealth(AsyncWorkerRunning, nil)
+	beatAsyncWorkerHealth()
+
+	scaler := newWorkerScaler(numWorkers)
+	work := make(chan *sarama.ConsumerMessage)
+	stop := make(chan bool, scaler.Max)
+	results := make(chan asyncWorkerResult, scaler.Max)
+	var workers sync.WaitGroup
+	defer func() {
+		close(work)
+		workers.Wait()
+	}()
+
+	running, nextWorkerNum := 0, 0
+	scaleTo := func(target int) {
+		for ; running < target; running++ {
+			workers.Add(1)
+			go runAsyncWorker(ctx, nextWorkerNum, work, stop, results, &workers)
+			nextWorkerNum++
+		}
+		for ; running > target; running-- {
+			stop <- true
+		}
 	}
+	scaleTo(scaler.Clamp(numWorkers))
+
+	stopLag := make(chan bool)
+	defer close(stopLag)
+	lags := pollConsumerLag(stopLag)
+
+	log.Printf("Worker started: [workers: %d] [min: %d] [max: %d]", running, scaler.Min, scaler.Max)
+
+	queue := newFairQueue()
+	tracker := newOffsetTracker()
+	sequences := newSequencer()
+	var next *sarama.ConsumerMessage
+	inFlight := 0
+	quitting := false
+	for !quitting || inFlight > 0 {
+		beatAsyncWorkerHealth()
+		if next == nil && !quitting {
+			// Messages held back for their sequence go first, since they were read first
+			if next = sequences.Next(); next == nil {
+				for next = queue.Pop(); next != nil; next = queue.Pop() {
+					if sequences.Start(next) {
+						break
+					}
+				}
+			}
+		}
 
-	log.Printf("Worker started: %d", workerNum)
+		// A nil channel is never ready, which turns off that case of the select
+		var dispatch chan *sarama.ConsumerMessage
+		if next != nil {
+			dispatch = work
+		}
+		var high, normal, low <-chan *sarama.ConsumerMessage
+		if !quitting && canReadAhead(queue.Len(), sequences.Len()) {
+			high, normal, low = messages[PriorityHigh], messages[PriorityNormal], messages[PriorityLow]
+		}
 
-	for {
-		time.Sleep(sleepDuration)
+		var priority string
+		var message *sarama.ConsumerMessage
+		var ok bool
 
 		select {
 		case <-quit:
-			log.Println("Interrupt detected. Closing Consumer on worker: ", workerNum)
-			if err := consumer.Close(); err != nil {
-				sarama.Logger.Printf("Error closing the consumer for worker %d: %s", workerNum, err)
+			// Messages that were read but not started are left uncommitted, so they're read again
+			log.Printf("Interrupt detected. Waiting for %d in-flight items", inFlight)
+			quitting = true
+			next = nil
+			continue
+		case dispatch <- next:
+			next = nil
+			inFlight++
+			continue
+		case message, ok = <-high:
+			priority = PriorityHigh
+		case message, ok = <-normal:
+			priority = PriorityNormal
+		case message, ok = <-low:
+			priority = PriorityLow
+		case consumerLag := <-lags:
+			buffered := queue.Len() + sequences.Len()
+			if next != nil {
+				buffered++
+			}
+			lag := consumerLag.Waiting(inFlight, buffered)
+			target := scaler.Target(running, inFlight, lag)
+			logWorkerScale(running, target, inFlight, lag)
+			scaleTo(target)
+			setAsyncWorkerMetrics(scaler, running, inFlight, lag)
+			continue
+		case result := <-results:
+			inFlight--
+			sequences.Done(result.Message)
+			if !result.Processed {
+				// Cancelled while shutting down.  It's left uncommitted so it's processed again.
+				continue
 			}
-			finished <- true
+
+			// Messages are processed out of order, so only commit once everything before this is done
+			if commit := tracker.Done(result.Message); commit != nil {
+				consumers[commit.Topic].CommitUpto(commit)
+			}
+			continue
+		}
+
+		if !ok {
+			return fmt.Errorf("The consumer for priority %s was closed", priority)
+		}
+		tracker.Add(message)
+		queue.Push(priority, message)
+	}
+
+	return nil
+}
+
+// Processes the messages handed out by the worker until there are no more, or the worker is
+// told to stop because the pool is shrinking
+func runAsyncWorker(ctx context.Context, workerNum int, work <-chan *sarama.ConsumerMessage, stop <-chan bool, results chan<- asyncWorkerResult, workers *sync.WaitGroup) {
+	defer workers.Done()
+	defer removeAsyncWorkerState(workerNum)
+
+	redis := GetAsyncJobRedis()
+	defer redis.Close()
+
+	for {
+		setAsyncWorkerIdle(workerNum)
+
+		select {
+		case <-stop:
 			return
-		case message := <-consumer.Messages():
-			processMessage(message, consumer, redis)
-			consumer.CommitUpto(message)
-		case <-time.After(sleepDuration):
+		case message, ok := <-work:
+			if !ok {
+				return
+			}
+			results <- asyncWorkerResult{
+				Message:   message,
+				Processed: processAsyncWorkerMessage(ctx, workerNum, message, redis),
+			}
 		}
 	}
 }
 
-// Process a single consumer message
-func processMessage(message *sarama.ConsumerMessage, consumer *consumergroup.ConsumerGroup, redis *redis.Client) {
+// Processes a single message.  A panic dead letters the message instead of killing the worker.
+func processAsyncWorkerMessage(ctx context.Context, workerNum int, message *sarama.ConsumerMessage, redis *redis.Client) (processed bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Worker %d panicked processing message: [key: %s] [offset: %d] [partition: %d] [topic: %s] (error: %s)", workerNum, message.Key, message.Offset, message.Partition, message.Topic, r)
+			err := AsyncItemError{Reason: "panic", Retry: false, Err: fmt.Errorf("%v", r)}
+			recordAsyncWorkerError(workerNum, message, err)
+			processed = deadLetterWithRetries(ctx, redis, message, 1, err)
+		}
+	}()
+
+	requestID, index := asyncMessageItem(message)
+	setAsyncWorkerProcessing(workerNum, requestID, index)
+
+	start := time.Now()
+	defer func() {
+		observeWorkerItem(message.Topic, time.Since(start))
+	}()
+
+	return processMessageWithRetries(ctx, workerNum, message, redis)
+}
+
+// Process a single consumer message, as part of the trace the item was sent with.  Returns an
+// AsyncItemError if the message couldn't be processed.
+func processMessage(ctx context.Context, message *sarama.ConsumerMessage, redis *redis.Client) (err error) {
 
 	log.Printf("Got message: [key: %s] [offset: %d] [partition: %d] [topid: %s] [value: %s]", message.Key, message.Offset, message.Partition, message.Topic, message.Value)
 
-	var batchItem AsyncBatchItem
-	err := json.Unmarshal(message.Value, &batchItem)
+	envelope, err := decodeAsyncMessage(message.Value)
 	if err != nil {
-		log.Printf("This shouldn't happen. We put this JSON into the Kafka queue and it should always be properly formatted. [key: %s] [offset: %d] [partition: %d] [topid: %s] [value: %s] (error: %s)", message.Key, message.Offset, message.Partition, message.Topic, message.Value, err)
-		return
+		log.Printf("Unable to read message: [key: %s] [offset: %d] [partition: %d] [topid: %s] [value: %s] (error: %s)", message.Key, message.Offset, message.Partition, message.Topic, message.Value, err)
+		return err
 	}
+	batchItem := envelope.Item
+
+	ctx, span := tracer.Start(contextWithTrace(ctx, envelope.TraceContext), "batch.async_item",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("batch.request_id", batchItem.RequestID),
+			attribute.Int64("batch.item.index", batchItem.Index),
+			attribute.String("messaging.kafka.topic", message.Topic),
+		))
+	defer func() {
+		endSpan(span, err)
+	}()
 
-	redisCheckCmd := redis.LIndex(batchItem.RequestID, batchItem.Index)
-	checkResult, err := redisCheckCmd.Result()
+	claim, claimed, err := claimAsyncItem(ctx, redis, batchItem.RequestID, batchItem.Index)
 	if err != nil {
-		log.Printf("An error occurred getting Redis info. [request ID: %s] [result: %s] (error: %s)", batchItem.RequestID, checkResult, err)
-		return
+		return AsyncItemError{Reason: "redis_claim", Retry: true, Err: err}
+	} else if !claimed {
+		return nil
 	}
 
-	if checkResult != "" {
-		log.Printf("Batch Item already processed: [request id: %s] [request index: %d] [key: %s] [offset: %d] [partition: %d] [topid: %s] [value: %s]", batchItem.RequestID, batchItem.Index, message.Key, message.Offset, message.Partition, message.Topic, message.Value)
-		return
+	status, _ := GetAsyncJobStatus(redis, batchItem.RequestID)
+	if status == AsyncJobFailed {
+		// Only some of the job's items were sent, so none of them are ran
+		log.Printf("Batch Item skipped, request failed to be sent to the workers: [request id: %s] [request index: %d] [key: %s] [offset: %d] [partition: %d] [topid: %s]", batchItem.RequestID, batchItem.Index, message.Key, message.Offset, message.Partition, message.Topic)
+		claim.Release(redis)
+		return nil
 	}
 
-	response, err := batchItem.Item.RequestItem(batchItem.IdentityID)
-	if err != nil {
-		log.Printf("An error occurred requesting batch item: [request id: %s] [key: %s] [offset: %d] [partition: %d] [topid: %s] [value: %s]", batchItem.RequestID, message.Key, message.Offset, message.Partition, message.Topic, message.Value)
-		response = BatchResponseItem{
-			Code: 500,
-			Body: err,
+	var response BatchResponseItem
+	if status == AsyncJobCancelled {
+		log.Printf("Batch Item skipped, request was cancelled: [request id: %s] [request index: %d] [key: %s] [offset: %d] [partition: %d] [topid: %s]", batchItem.RequestID, batchItem.Index, message.Key, message.Offset, message.Partition, message.Topic)
+		response = AsyncCancelledResponse
+	} else {
+		done := make(chan bool)
+		go claim.KeepAlive(redis, done)
+		response, err = batchItem.Item.RequestItem(ctx, batchItem.IdentityID)
+		close(done)
+		if ctx.Err() != nil {
+			log.Printf("Batch item cancelled while shutting down: [request id: %s] [request index: %d] [key: %s] [offset: %d] [partition: %d] [topid: %s]", batchItem.RequestID, batchItem.Index, message.Key, message.Offset, message.Partition, message.Topic)
+			claim.Release(redis)
+			return AsyncItemError{Reason: "cancelled", Retry: false, Err: ctx.Err()}
+		} else if err != nil {
+			log.Printf("An error occurred requesting batch item: [request id: %s] [key: %s] [offset: %d] [partition: %d] [topid: %s] [value: %s]", batchItem.RequestID, message.Key, message.Offset, message.Partition, message.Topic, message.Value)
+			response = BatchResponseItem{
+				Code: 500,
+				Body: err,
+			}
 		}
 	}
 
-	responseJson, _ := json.Marshal(response)
-	redisPutCmd := redis.LSet(batchItem.RequestID, batchItem.Index, string(responseJson))
-	putResult, err := redisPutCmd.Result()
+	saved, finished, err := saveAsyncItemResult(redis, claim, response)
 	if err != nil {
-		log.Printf("An error occurred putting batch item response into Redis: [request id: %s] [request index: %d] [key: %s] [offset: %d] [partition: %d] [topid: %s] [value: %s] (error: %s)", batchItem.RequestID, batchItem.Index, message.Key, message.Offset, message.Partition, message.Topic, message.Value, err)
-	} else {
-		log.Printf("Successfully processed batch item: [request id: %s] [request index: %d] [key: %s] [offset: %d] [partition: %d] [topid: %s] [value: %s] (result: %s)", batchItem.RequestID, batchItem.Index, message.Key, message.Offset, message.Partition, message.Topic, message.Value, putResult)
+		log.Printf("Batch item result couldn't be saved, dead lettering it: [request id: %s] [request index: %d] [key: %s] [offset: %d] [partition: %d] [topid: %s] [value: %s] (error: %s)", batchItem.RequestID, batchItem.Index, message.Key, message.Offset, message.Partition, message.Topic, message.Value, err)
+		return err
+	} else if !saved {
+		return nil
 	}
 
+	log.Printf("Successfully processed batch item: [request id: %s] [request index: %d] [key: %s] [offset: %d] [partition: %d] [topid: %s] [value: %s]", batchItem.RequestID, batchItem.Index, message.Key, message.Offset, message.Partition, message.Topic, message.Value)
+	if finished {
+		// The job's callback, if it has one, was made pending along with its last item
+		log.Printf("Async job complete: [request id: %s]", batchItem.RequestID)
+	}
+	return nil
+}
+
+// Saves the result of a claimed item, trying again with a backoff while writing it fails.  Only
+// the write is tried again, since the item's request was already made and may not be safe to
+// repeat.  Returns an AsyncItemError that can't be retried if the result still can't be saved.
+// The claim is kept in that case, so the item isn't ran again until its lease runs out.  finished
+// is true if the item was the job's last.
+func saveAsyncItemResult(redis *redis.Client, claim asyncItemClaim, response BatchResponseItem) (saved bool, finished bool, err error) {
+	backoff := time.Duration(ASYNC_ITEM_BACKOFF) * time.Millisecond
+	for attempts := 1; ; attempts++ {
+		reason := "blob_write"
+		var responseJson string
+		responseJson, err = encodeAsyncResult(claim.RequestID, claim.Index, response)
+		if err == nil {
+			reason = "redis_write"
+			saved, finished, err = claim.Complete(redis, responseJson)
+			if err == nil {
+				return saved, finished, nil
+			}
+			countRedisError("complete_item")
+			log.Printf("An error occurred putting batch item response into Redis: [request id: %s] [request index: %d] [attempt: %d] (error: %s)", claim.RequestID, claim.Index, attempts, err)
+		}
+
+		if attempts >= ASYNC_ITEM_ATTEMPTS {
+			return false, false, AsyncItemError{Reason: reason, Retry: false, Requested: true, Err: err}
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
 }
 
 // Get a response for an async request
@@ -182,6 +536,7 @@ func RetrieveAsyncResponse(requestID string) (BatchResponse, error) {
 	existsCmd := redis.Exists(requestID)
 	existsResult, err := existsCmd.Result()
 	if err != nil {
+		countRedisError("get_results")
 		log.Printf("An error occurred attempting to check if async batch request still exists: [request id: %s] (error: %s)", requestID, err)
 	} else {
 		log.Printf("Successfully retreived async job exists from redis. [request id: %s] (result: %t)", requestID, existsResult)
@@ -193,6 +548,7 @@ func RetrieveAsyncResponse(requestID string) (BatchResponse, error) {
 	getCmd := redis.LRange(requestID, 0, -1)
 	getResult, err := getCmd.Result()
 	if err != nil {
+		countRedisError("get_results")
 		log.Printf("An error occurred attempting to get response data for async batch request: [request id: %s] (error: %s)", requestID, err)
 	} else {
 		log.Printf("Successfully retreived async response data from redis. [request id: %s] (result: %s)", requestID, getResult)
@@ -207,11 +563,212 @@ func RetrieveAsyncResponse(requestID string) (BatchResponse, error) {
 
 	batchResponse := make(BatchResponse, len(getResult))
 	for idx, response := range getResult {
-		var responseItem BatchResponseItem
-		_ = json.Unmarshal([]byte(response), &responseItem)
+		responseItem, err := decodeAsyncResult(requestID, int64(idx), response)
+		if err != nil {
+			return BatchResponse{}, err
+		}
 		batchResponse[idx] = responseItem
 	}
 
 	return batchResponse, nil
 
 }
+
+// A run of indexes of an async response, from From to To inclusive
+type AsyncIndexRange struct {
+	From int64
+	To   int64
+}
+
+// The most runs of skipped pending items a cursor keeps, so it stays short enough for a URL
+const asyncCursorMaxPending = 100
+
+// Adds a run to the end of the runs, joining it to the last run if they touch
+func appendAsyncRange(runs []AsyncIndexRange, run AsyncIndexRange) []AsyncIndexRange {
+	if last := len(runs) - 1; last >= 0 && runs[last].To+1 >= run.From {
+		if run.To > runs[last].To {
+			runs[last].To = run.To
+		}
+		return runs
+	}
+	return append(runs, run)
+}
+
+// Encodes where to continue reading an async response from: the index after the last one read,
+// and the runs of pending items that were skipped, which are checked again first
+func EncodeAsyncCursor(next int64, pending []AsyncIndexRange) string {
+	cursor := strconv.FormatInt(next, 10)
+	if len(pending) > 0 {
+		runs := make([]string, len(pending))
+		for idx, run := range pending {
+			runs[idx] = fmt.Sprintf("%d-%d", run.From, run.To)
+		}
+		cursor += ":" + strings.Join(runs, ",")
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(cursor))
+}
+
+// Decodes a cursor created by EncodeAsyncCursor
+func DecodeAsyncCursor(cursor string) (int64, []AsyncIndexRange, error) {
+	invalid := fmt.Errorf("Invalid cursor: %s", cursor)
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, nil, invalid
+	}
+
+	parts := strings.SplitN(string(data), ":", 2)
+	next, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || next < 0 {
+		return 0, nil, invalid
+	} else if len(parts) == 1 {
+		return next, nil, nil
+	}
+
+	var pending []AsyncIndexRange
+	for _, run := range strings.Split(parts[1], ",") {
+		bounds := strings.SplitN(run, "-", 2)
+		if len(bounds) != 2 {
+			return 0, nil, invalid
+		}
+		from, fromErr := strconv.ParseInt(bounds[0], 10, 64)
+		to, toErr := strconv.ParseInt(bounds[1], 10, 64)
+		if fromErr != nil || toErr != nil || from < 0 || to < from || to >= next {
+			return 0, nil, invalid
+		} else if len(pending) > 0 && from <= pending[len(pending)-1].To {
+			return 0, nil, invalid
+		}
+		pending = append(pending, AsyncIndexRange{From: from, To: to})
+	}
+
+	return next, pending, nil
+}
+
+// Get a single page of the response for an async request.  Unlike RetrieveAsyncResponse this
+// returns the items that have finished while the rest of the request is still being processed.
+func RetrieveAsyncResponsePage(requestID string, query AsyncResponseQuery) (AsyncResponsePage, error) {
+	offset := query.Offset
+	var pending []AsyncIndexRange
+	if query.Cursor != "" {
+		var err error
+		offset, pending, err = DecodeAsyncCursor(query.Cursor)
+		if err != nil {
+			return AsyncResponsePage{}, err
+		}
+	}
+	if offset < 0 {
+		return AsyncResponsePage{}, fmt.Errorf("Invalid offset: %d", offset)
+	}
+	if !query.CompletedOnly {
+		pending = nil
+	}
+
+	limit := query.Limit
+	if limit <= 0 {
+		limit = ASYNC_PAGE_LIMIT
+	} else if limit > ASYNC_PAGE_MAX_LIMIT {
+		limit = ASYNC_PAGE_MAX_LIMIT
+	}
+
+	redis := GetAsyncJobRedis()
+	defer redis.Close()
+
+	totalCmd := redis.LLen(requestID)
+	total, err := totalCmd.Result()
+	if err != nil {
+		countRedisError("get_results")
+		log.Printf("An error occurred attempting to get the size of async batch request: [request id: %s] (error: %s)", requestID, err)
+		return AsyncResponsePage{}, fmt.Errorf("An internal server error occurred.")
+	} else if total == 0 {
+		return AsyncResponsePage{}, fmt.Errorf("The async batch request can not be found.  It may have expired.")
+	}
+
+	page := AsyncResponsePage{
+		RequestID: requestID,
+		Total:     total,
+		Offset:    offset,
+		Limit:     limit,
+		Items:     []AsyncResponsePageItem{},
+	}
+
+	// When only completed items are requested keep reading chunks until the page is full, so the
+	// client doesn't get a run of empty pages while the items in front are pending.  The pending
+	// items skipped go in the cursor, so they're returned once they finish without returning the
+	// finished items around them again.
+	var skipped []AsyncIndexRange
+	read := func(start, end int64) (int64, error) {
+		for start <= end && int64(len(page.Items)) < limit {
+			chunkEnd := start + limit - 1
+			if chunkEnd > end {
+				chunkEnd = end
+			}
+
+			getCmd := redis.LRange(requestID, start, chunkEnd)
+			getResult, err := getCmd.Result()
+			if err != nil {
+				countRedisError("get_results")
+				log.Printf("An error occurred attempting to get response data for async batch request: [request id: %s] [start: %d] [end: %d] (error: %s)", requestID, start, chunkEnd, err)
+				return start, fmt.Errorf("An internal server error occurred.")
+			} else if len(getResult) == 0 {
+				return start, nil
+			}
+
+			for idx, response := range getResult {
+				index := start + int64(idx)
+				if int64(len(page.Items)) >= limit {
+					return index, nil
+				}
+
+				pageItem := AsyncResponsePageItem{Index: index}
+				if response != "" {
+					responseItem, err := decodeAsyncResult(requestID, index, response)
+					if err != nil {
+						return index, err
+					}
+					pageItem.Complete = true
+					pageItem.Response = &responseItem
+				} else if query.CompletedOnly {
+					if last := len(skipped) - 1; len(skipped) >= asyncCursorMaxPending && skipped[last].To+1 != index {
+						return index, nil
+					}
+					skipped = appendAsyncRange(skipped, AsyncIndexRange{From: index, To: index})
+					continue
+				}
+
+				page.Items = append(page.Items, pageItem)
+			}
+			start += int64(len(getResult))
+		}
+		return start, nil
+	}
+
+	for idx, run := range pending {
+		from, err := read(run.From, run.To)
+		if err != nil {
+			return AsyncResponsePage{}, err
+		} else if from <= run.To {
+			// The page filled up before the whole run was checked
+			skipped = appendAsyncRange(skipped, AsyncIndexRange{From: from, To: run.To})
+			skipped = append(skipped, pending[idx+1:]...)
+			break
+		}
+	}
+
+	next, err := read(offset, total-1)
+	if err != nil {
+		return AsyncResponsePage{}, err
+	}
+
+	if len(skipped) > 0 || next < total {
+		page.NextCursor = EncodeAsyncCursor(next, skipped)
+	}
+
+	indexes := make([]int64, len(page.Items))
+	for idx, pageItem := range page.Items {
+		indexes[idx] = pageItem.Index
+	}
+	for idx, attempts := range getAsyncItemAttempts(redis, requestID, indexes) {
+		page.Items[idx].Attempts = attempts
+	}
+
+	return page, nil
+}
@@ -0,0 +1,118 @@
+package model
+
+import (
+	"encoding/base64"
+	"fmt"
+	"testing"
+)
+
+func TestAsyncCursor(t *testing.T) {
+	tests := []struct {
+		name    string
+		next    int64
+		pending []AsyncIndexRange
+	}{
+		{"start", 0, nil},
+		{"no pending", 42, nil},
+		{"one pending", 10, []AsyncIndexRange{{3, 3}}},
+		{"pending runs", 100, []AsyncIndexRange{{0, 4}, {7, 7}, {50, 99}}},
+	}
+
+	for _, test := range tests {
+		next, pending, err := DecodeAsyncCursor(EncodeAsyncCursor(test.next, test.pending))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		} else if next != test.next || fmt.Sprint(pending) != fmt.Sprint(test.pending) {
+			t.Errorf("%s: decoded %d %v, expected %d %v", test.name, next, pending, test.next, test.pending)
+		}
+	}
+}
+
+func TestDecodeInvalidAsyncCursor(t *testing.T) {
+	tests := []struct {
+		name   string
+		cursor string
+	}{
+		{"not a number", "abc"},
+		{"negative", "-1"},
+		{"bad run", "10:3"},
+		{"backwards run", "10:5-3"},
+		{"run past the next index", "10:5-10"},
+		{"overlapping runs", "10:1-4,3-5"},
+	}
+
+	if _, _, err := DecodeAsyncCursor("!!!"); err == nil {
+		t.Errorf("Expected a cursor that isn't base64 to be invalid")
+	}
+	for _, test := range tests {
+		cursor := base64.RawURLEncoding.EncodeToString([]byte(test.cursor))
+		if _, _, err := DecodeAsyncCursor(cursor); err == nil {
+			t.Errorf("%s: expected %q to be invalid", test.name, test.cursor)
+		}
+	}
+}
+
+func TestAppendAsyncRange(t *testing.T) {
+	tests := []struct {
+		name     string
+		runs     []AsyncIndexRange
+		run      AsyncIndexRange
+		expected []AsyncIndexRange
+	}{
+		{"first", nil, AsyncIndexRange{3, 3}, []AsyncIndexRange{{3, 3}}},
+		{"next to the last", []AsyncIndexRange{{1, 3}}, AsyncIndexRange{4, 4}, []AsyncIndexRange{{1, 4}}},
+		{"overlapping the last", []AsyncIndexRange{{1, 3}}, AsyncIndexRange{3, 6}, []AsyncIndexRange{{1, 6}}},
+		{"apart from the last", []AsyncIndexRange{{1, 3}}, AsyncIndexRange{5, 5}, []AsyncIndexRange{{1, 3}, {5, 5}}},
+	}
+
+	for _, test := range tests {
+		if runs := appendAsyncRange(test.runs, test.run); fmt.Sprint(runs) != fmt.Sprint(test.expected) {
+			t.Errorf("%s: got %v, expected %v", test.name, runs, test.expected)
+		}
+	}
+}
+
+func TestRetrieveAsyncResponsePageCompletedOnly(t *testing.T) {
+	redis := testRedis(t)
+	defer redis.Close()
+
+	done := `{"code":200}`
+	requestID := testAsyncJob(t, redis, AsyncJobPending, done, "", done, "", done)
+	query := AsyncResponseQuery{Limit: 2, CompletedOnly: true}
+
+	// Reads the pages until there's no cursor or an empty page, and returns the indexes read
+	readPages := func() []int64 {
+		indexes := []int64{}
+		for {
+			page, err := RetrieveAsyncResponsePage(requestID, query)
+			if err != nil {
+				t.Fatalf("Unable to get the page: %s", err)
+			}
+			for _, item := range page.Items {
+				indexes = append(indexes, item.Index)
+			}
+			query.Cursor = page.NextCursor
+			if page.NextCursor == "" || len(page.Items) == 0 {
+				return indexes
+			}
+		}
+	}
+
+	if indexes := readPages(); fmt.Sprint(indexes) != fmt.Sprint([]int64{0, 2, 4}) {
+		t.Errorf("Expected the finished items, got %v", indexes)
+	} else if query.Cursor == "" {
+		t.Fatalf("Expected a cursor while items are pending")
+	}
+
+	redis.LSet(requestID, 3, done)
+	if indexes := readPages(); fmt.Sprint(indexes) != fmt.Sprint([]int64{3}) {
+		t.Errorf("Expected only the item that finished since, got %v", indexes)
+	}
+
+	redis.LSet(requestID, 1, done)
+	if indexes := readPages(); fmt.Sprint(indexes) != fmt.Sprint([]int64{1}) {
+		t.Errorf("Expected only the item that finished since, got %v", indexes)
+	} else if query.Cursor != "" {
+		t.Errorf("Expected no cursor once every item is returned")
+	}
+}
@@ -0,0 +1,165 @@
+package model
+
+import (
+	"expvar"
+	"log"
+	"time"
+)
+
+var WORKERS_MIN int = 0
+var WORKERS_MAX int = 0
+var WORKERS_SCALE_INTERVAL int = 5000
+
+// Metrics for the async workers, published with expvar
+var asyncWorkerMetrics = expvar.NewMap("asyncWorkers")
+
+// Grows and shrinks the number of workers between a min and a max based on the lag, which is the
+// number of messages in kafka that are waiting for a worker.
+type workerScaler struct {
+	Min int
+	Max int
+}
+
+// Get the scaler for the workers.  WORKERS_MIN and WORKERS_MAX default to numWorkers, so the
+// number of workers is fixed unless they are set.
+func newWorkerScaler(numWorkers int) workerScaler {
+	scaler := workerScaler{Min: WORKERS_MIN, Max: WORKERS_MAX}
+	if scaler.Min <= 0 {
+		scaler.Min = numWorkers
+	}
+	if scaler.Max <= 0 {
+		scaler.Max = numWorkers
+	}
+	if scaler.Min < 1 {
+		scaler.Min = 1
+	}
+	if scaler.Max < scaler.Min {
+		scaler.Max = scaler.Min
+	}
+	return scaler
+}
+
+// Keeps the number of workers between the min and the max
+func (scaler workerScaler) Clamp(workers int) int {
+	if workers < scaler.Min {
+		return scaler.Min
+	} else if workers > scaler.Max {
+		return scaler.Max
+	}
+	return workers
+}
+
+// Get the number of workers there should be.  The workers double while they're all busy and there
+// are still messages waiting, and let half of the idle workers go when nothing is waiting.
+func (scaler workerScaler) Target(workers, inFlight, lag int) int {
+	target := workers
+	if lag > 0 && inFlight >= workers {
+		target = workers * 2
+	} else if lag == 0 && inFlight < workers {
+		target = workers - (workers-inFlight+1)/2
+	}
+	return scaler.Clamp(target)
+}
+
+// The lag of the consumer groups, read in the background.  Err is set if it couldn't be read.
+type consumerLag struct {
+	Partitions []PartitionLag
+	Err        error
+}
+
+// Get the lag summed over every partition
+func (lag consumerLag) Total() int {
+	total := int64(0)
+	for _, partition := range lag.Partitions {
+		total += partition.Lag
+	}
+	return int(total)
+}
+
+// Get the number of messages waiting for a worker.  That's the lag in kafka, less the messages
+// the workers already have in flight, which aren't committed yet.  If the lag in kafka couldn't
+// be read, only the messages buffered here are counted.
+func (lag consumerLag) Waiting(inFlight, buffered int) int {
+	if lag.Err != nil {
+		return buffered
+	}
+
+	waiting := lag.Total() - inFlight
+	if waiting < buffered {
+		return buffered
+	}
+	return waiting
+}
+
+// Reads the lag of the consumer groups every WORKERS_SCALE_INTERVAL until done is closed.  This runs
+// in the background and sends each reading on the returned channel, so the dispatcher never waits
+// on zookeeper or kafka.
+func pollConsumerLag(done <-chan bool) <-chan consumerLag {
+	lags := make(chan consumerLag)
+	go func() {
+		var reader ConsumerLagReader
+		defer func() {
+			if reader != nil {
+				reader.Close()
+			}
+		}()
+
+		ticker := time.NewTicker(time.Duration(WORKERS_SCALE_INTERVAL) * time.Millisecond)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			var lag consumerLag
+			if reader == nil {
+				reader, lag.Err = NewConsumerLagReader(ZOOKEEPER)
+			}
+			if lag.Err == nil {
+				if lag.Partitions, lag.Err = reader.Lag(); lag.Err != nil {
+					// Connect again next time, in case the brokers changed
+					reader.Close()
+					reader = nil
+				}
+			}
+			if lag.Err != nil {
+				log.Printf("An error occurred reading the consumer lag. Scaling on the buffered messages: %s", lag.Err)
+			} else {
+				observeConsumerLag(lag.Partitions)
+			}
+
+			select {
+			case <-done:
+				return
+			case lags <- lag:
+			}
+		}
+	}()
+	return lags
+}
+
+// Publishes the lag and concurrency of the workers
+func setAsyncWorkerMetrics(scaler workerScaler, workers, inFlight, lag int) {
+	observeWorkers(workers, inFlight)
+	for name, value := range map[string]int{
+		"lag":      lag,
+		"workers":  workers,
+		"inFlight": inFlight,
+		"min":      scaler.Min,
+		"max":      scaler.Max,
+	} {
+		metric := new(expvar.Int)
+		metric.Set(int64(value))
+		asyncWorkerMetrics.Set(name, metric)
+	}
+}
+
+// Logs a change in the number of workers
+func logWorkerScale(from, to, inFlight, lag int) {
+	if from != to {
+		log.Printf("Scaling workers: [from: %d] [to: %d] [in flight: %d] [lag: %d]", from, to, inFlight, lag)
+	}
+}
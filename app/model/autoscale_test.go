@@ -0,0 +1,52 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+)
+
+func TestWorkerScalerTarget(t *testing.T) {
+	scaler := workerScaler{Min: 1, Max: 8}
+	tests := []struct {
+		name     string
+		workers  int
+		inFlight int
+		lag      int
+		expected int
+	}{
+		{"all busy with messages waiting", 2, 2, 5, 4},
+		{"doubling stops at the max", 8, 8, 100, 8},
+		{"doubling is cut to the max", 6, 6, 1, 8},
+		{"some idle with messages waiting", 4, 2, 5, 4},
+		{"all busy with nothing waiting", 4, 4, 0, 4},
+		{"some idle with nothing waiting", 4, 1, 0, 2},
+		{"all idle with nothing waiting", 4, 0, 0, 2},
+		{"shrinking stops at the min", 1, 0, 0, 1},
+		{"below the min", 0, 0, 0, 1},
+	}
+
+	for _, test := range tests {
+		if target := scaler.Target(test.workers, test.inFlight, test.lag); target != test.expected {
+			t.Errorf("%s: target %d, expected %d", test.name, target, test.expected)
+		}
+	}
+}
+
+func TestHeadOffsetQuery(t *testing.T) {
+	tests := []struct {
+		name       string
+		headOffset int64
+		expected   int64
+	}{
+		{"unset", 0, sarama.OffsetOldest},
+		{"oldest", sarama.OffsetOldest, sarama.OffsetOldest},
+		{"newest", sarama.OffsetNewest, sarama.OffsetNewest},
+	}
+
+	for _, test := range tests {
+		if query := headOffsetQuery(test.headOffset); query != test.expected {
+			t.Errorf("%s: got %d, expected %d", test.name, query, test.expected)
+		}
+	}
+}
@@ -2,20 +2,25 @@ package model
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/pborman/uuid"
-	"time"
-	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Contains the mapping for internal services
 var HostMap map[string]string
 
+var ITEM_REQUEST_TIMEOUT int = 60
+
 // Interface for the http method "Do", useful for mocking requests/responses
 type BatchClient interface {
 	Do(req *http.Request) (resp *http.Response, err error)
@@ -26,6 +31,8 @@ type BatchResponseItem struct {
 	Code    int               `json:"code"`
 	Body    interface{}       `json:"body"`
 	Headers map[string]string `json:"headers"`
+	BodyURL string            `json:"bodyUrl,omitempty"`
+	BodyRef *BlobRef          `json:"bodyRef,omitempty"`
 }
 
 // The list of responses for all of the batch item requests
@@ -33,10 +40,11 @@ type BatchResponse []BatchResponseItem
 
 // A single batch item request
 type BatchItem struct {
-	Method  string            `json:"method"`
-	URL     string            `json:"url"`
-	Body    interface{}       `json:"body"`
-	Headers map[string]string `json:"headers"`
+	Method      string            `json:"method"`
+	URL         string            `json:"url"`
+	Body        interface{}       `json:"body"`
+	Headers     map[string]string `json:"headers"`
+	OrderingKey string            `json:"orderingKey,omitempty"`
 }
 
 // Get the URL to hit for an internal request batch item
@@ -54,8 +62,8 @@ func (batchItem BatchItem) InternalURL() (string, error) {
 	return domain + parts[1], nil
 }
 
-// Create a request for this internal request batch item
-func (batchItem BatchItem) NewInternalRequest(identityID string) (*http.Request, error) {
+// Create a request for this internal request batch item, as part of the trace in ctx
+func (batchItem BatchItem) NewInternalRequest(ctx context.Context, identityID string) (*http.Request, error) {
 	data, _ := json.Marshal(batchItem.Body)
 	url, jsonErr := batchItem.InternalURL()
 	if jsonErr != nil {
@@ -72,11 +80,12 @@ func (batchItem BatchItem) NewInternalRequest(identityID string) (*http.Request,
 		request.Header.Add(header, val)
 	}
 	request.Header.Add("X-IdentityID", identityID)
+	injectTraceHeaders(ctx, request)
 	return request, nil
 }
 
-// Create a request for this external request batch item
-func (batchItem BatchItem) NewExternalRequest(identityID string) (*http.Request, error) {
+// Create a request for this external request batch item, as part of the trace in ctx
+func (batchItem BatchItem) NewExternalRequest(ctx context.Context, identityID string) (*http.Request, error) {
 	data, _ := json.Marshal(batchItem.Body)
 
 	request, err := http.NewRequest(strings.ToUpper(batchItem.Method), batchItem.URL, bytes.NewBuffer(data))
@@ -88,24 +97,25 @@ func (batchItem BatchItem) NewExternalRequest(identityID string) (*http.Request,
 	for header, val := range batchItem.Headers {
 		request.Header.Add(header, val)
 	}
+	injectTraceHeaders(ctx, request)
 
 	return request, nil
 }
 
-// Create a request for this request batch item
-func (batchItem BatchItem) NewRequest(identityID string) (*http.Request, error) {
+// Create a request for this request batch item, as part of the trace in ctx
+func (batchItem BatchItem) NewRequest(ctx context.Context, identityID string) (*http.Request, error) {
 	var request *http.Request
 	var err error
 	if strings.HasPrefix(batchItem.URL, "http") {
 		// Represents a request to an external system
-		request, err = batchItem.NewExternalRequest(identityID)
+		request, err = batchItem.NewExternalRequest(ctx, identityID)
 		if err != nil {
 			log.Printf("An error occurred creating request: %s %+v", err, batchItem)
 			return request, err
 		}
 	} else {
 		// Represents a request to an internal system
-		request, err = batchItem.NewInternalRequest(identityID)
+		request, err = batchItem.NewInternalRequest(ctx, identityID)
 		if err != nil {
 			log.Printf("An error occurred creating request: %s %+v", err, batchItem)
 			return request, err
@@ -114,14 +124,17 @@ func (batchItem BatchItem) NewRequest(identityID string) (*http.Request, error)
 	return request, err
 }
 
-// Make a request for this batch item
-func (batchItem BatchItem) Do(request *http.Request) (BatchResponseItem, error) {
+// Make a request for this batch item.  The request is cancelled if ctx is done before it finishes.
+func (batchItem BatchItem) Do(ctx context.Context, request *http.Request) (BatchResponseItem, error) {
 	client := GetRequestClient()
-	response, err := client.Do(request)
+	start := time.Now()
+	response, err := client.Do(request.WithContext(ctx))
 	if err != nil {
+		observeItemRequest(batchItem, 0, err, time.Since(start))
 		log.Printf("An error occurred calling the new batch request: %s", err)
 		return BatchResponseItem{}, fmt.Errorf("An Internal Server error occurred making the request")
 	}
+	observeItemRequest(batchItem, response.StatusCode, nil, time.Since(start))
 
 	responseItem := BatchResponseItem{
 		Code: response.StatusCode,
@@ -137,14 +150,18 @@ func (batchItem BatchItem) Do(request *http.Request) (BatchResponseItem, error)
 }
 
 // Request a single item from the BatchItems.  Meant to be used asynchronously using a channel.
-func (batchItem BatchItem) RequestItemAsync(response chan interface{}, identityID string) {
-	request, jsonErr := batchItem.NewRequest(identityID)
+func (batchItem BatchItem) RequestItemAsync(ctx context.Context, response chan interface{}, identityID string) {
+	ctx, span := startItemSpan(ctx, batchItem)
+
+	request, jsonErr := batchItem.NewRequest(ctx, identityID)
 	if jsonErr != nil {
+		endItemSpan(span, BatchResponseItem{}, jsonErr)
 		response <- jsonErr
 		return
 	}
 
-	responseItem, err := batchItem.Do(request)
+	responseItem, err := batchItem.Do(ctx, request)
+	endItemSpan(span, responseItem, err)
 	if err != nil {
 		log.Printf("An error occurred making request: %s %+v", err, batchItem)
 		response <- err
@@ -155,13 +172,17 @@ func (batchItem BatchItem) RequestItemAsync(response chan interface{}, identityI
 }
 
 // Request a single item from the BatchItems.  Meant to be used asynchronously using a channel.
-func (batchItem BatchItem) RequestItem(identityID string) (BatchResponseItem, error) {
-	request, jsonErr := batchItem.NewRequest(identityID)
+func (batchItem BatchItem) RequestItem(ctx context.Context, identityID string) (BatchResponseItem, error) {
+	ctx, span := startItemSpan(ctx, batchItem)
+
+	request, jsonErr := batchItem.NewRequest(ctx, identityID)
 	if jsonErr != nil {
+		endItemSpan(span, BatchResponseItem{}, jsonErr)
 		return BatchResponseItem{}, jsonErr
 	}
 
-	responseItem, err := batchItem.Do(request)
+	responseItem, err := batchItem.Do(ctx, request)
+	endItemSpan(span, responseItem, err)
 	if err != nil {
 		log.Printf("An error occurred making request: %s %+v", err, batchItem)
 		return responseItem, fmt.Errorf("An internal server error occurred")
@@ -181,12 +202,14 @@ func (batchItems BatchItems) MakeError(code int, err error) BatchResponseItem {
 }
 
 // Runs all of the jobs in this list of batch items
-func (batchItems BatchItems) RunBatch(identityID string) BatchResponse {
+func (batchItems BatchItems) RunBatch(ctx context.Context, identityID string) BatchResponse {
+	ctx, span := tracer.Start(ctx, "batch.run", trace.WithAttributes(attribute.Int("batch.items", len(batchItems))))
+	defer span.End()
 
 	batchResponseChans := make([]chan interface{}, len(batchItems))
 	for idx, batchItem := range batchItems {
 		batchResponseChans[idx] = make(chan interface{})
-		go batchItem.RequestItemAsync(batchResponseChans[idx], identityID)
+		go batchItem.RequestItemAsync(ctx, batchResponseChans[idx], identityID)
 	}
 
 	batchResponse := make(BatchResponse, len(batchItems))
@@ -206,58 +229,154 @@ func (batchItems BatchItems) RunBatch(identityID string) BatchResponse {
 	return batchResponse
 }
 
-// Runs all of the jobs in this list of batch items
-func (batchItems BatchItems) RunBatchAsync(identityID string) (string, error) {
-
-	producer, err := GetAsyncBatchProducer()
-	if err != nil {
-		return "", fmt.Errorf("An internal server error occurred.")
-	}
-	defer producer.Close()
+// Runs all of the jobs in this list of batch items asynchronously.  The items are processed as
+// part of the trace in ctx.
+func (batchItems BatchItems) RunBatchAsync(ctx context.Context, identityID string, options AsyncBatchOptions) (string, error) {
 
 	requestID := uuid.New()
-	for idx, batchItem := range batchItems {
-		asyncItem := AsyncBatchItem{
-			RequestID:  requestID,
-			Index:      int64(idx),
-			Item:       batchItem,
-			IdentityID: identityID,
-		}
-		output, _ := json.Marshal(asyncItem)
-		message := &sarama.ProducerMessage{
-			Topic: TOPIC,
-			Key:   sarama.ByteEncoder(identityID + batchItem.URL),
-			Value: sarama.ByteEncoder(output),
-		}
-
-		partition, offset, err := producer.SendMessage(message)
-		if err != nil {
-			log.Printf("An error occurred sending message to Kafka. (error: %s)", err)
-			return "", fmt.Errorf("An internal server error occurred.")
-		} else {
-			log.Printf("Items successfully sent: [request id: %s] [parition: %d] (offset: %d)", requestID, partition, offset)
-		}
-	}
+	ctx, span := tracer.Start(ctx, "batch.run_async", trace.WithAttributes(
+		attribute.Int("batch.items", len(batchItems)),
+		attribute.String("batch.request_id", requestID),
+	))
+	defer span.End()
+	runAt := options.ScheduledFor()
+	scheduled := runAt.After(time.Now())
 
 	redis := GetAsyncJobRedis()
 	defer redis.Close()
 
+	// The job has to be in redis before any of its items can be picked up by a worker
 	pushCmd := redis.LPush(requestID, make([]string, len(batchItems))...)
 	pushResult, err := pushCmd.Result()
 	if err != nil {
+		countRedisError("create_job")
 		log.Printf("An error occurred saving new request to Redis: [request id: %s] [Result: %d] (error: %s)", requestID, pushResult, err)
 		return "", fmt.Errorf("An internal server error occurred.")
 	} else {
 		log.Printf("New async batch request successfully sent to redis: [request id: %s] [Num Items: %d]", requestID, pushResult)
 	}
 
-	expireCmd := redis.Expire(requestID, time.Duration(ASYNC_EXPIRE)*time.Minute)
-	expireResult, err := expireCmd.Result()
+	job := AsyncJob{
+		RequestID:       requestID,
+		IdentityID:      identityID,
+		Status:          AsyncJobPending,
+		Total:           int64(len(batchItems)),
+		Created:         time.Now(),
+		CallbackURL:     options.CallbackURL,
+		CallbackHeaders: options.CallbackHeaders,
+		CallbackSecret:  options.CallbackSecret,
+		Priority:        options.Priority,
+		Ordering:        options.Ordering,
+		ResultTTL:       options.ResultTTLSeconds(),
+		TraceContext:    traceContextOf(ctx),
+	}
+	if job.Priority == "" {
+		job.Priority = PriorityNormal
+	}
+	if job.Ordering == "" {
+		job.Ordering = OrderingNone
+	}
+	if job.CallbackURL != "" {
+		job.CallbackStatus = CallbackPending
+	}
+	if scheduled {
+		job.Status = AsyncJobScheduled
+		job.RunAt = runAt
+	}
+
+	if err := SaveAsyncJob(redis, job); err != nil {
+		redis.Del(AsyncJobKeys(requestID)...)
+		return "", fmt.Errorf("An internal server error occurred.")
+	}
+
+	// Keeping the items doubles the memory a job takes in redis, but without them it can't be
+	// retried or requeued.  Scheduled jobs always keep them, since that's what they're sent from.
+	if ASYNC_SAVE_ITEMS || scheduled {
+		if err := saveAsyncJobItems(redis, requestID, batchItems); err != nil {
+			redis.Del(AsyncJobKeys(requestID)...)
+			return "", fmt.Errorf("An internal server error occurred.")
+		}
+	}
+
+	// Until the job completes it's kept for ASYNC_EXPIRE minutes, which restarts whenever an item
+	// finishes.  The result TTL only starts once the job completes.
+	expiration := time.Duration(ASYNC_EXPIRE) * time.Minute
+	if scheduled {
+		// Scheduled jobs have to live until they run, and then for as long as any other job
+		expiration += runAt.Sub(time.Now())
+		if err := ScheduleAsyncJob(redis, requestID, runAt); err != nil {
+			redis.Del(AsyncJobKeys(requestID)...)
+			return "", fmt.Errorf("An internal server error occurred.")
+		}
+	}
+
+	if err := ExpireAsyncJob(redis, requestID, expiration); err == nil {
+		log.Printf("Expiration on new async batch request successfully sent to redis: [request id: %s]", requestID)
+	}
+
+	if scheduled {
+		return requestID, nil
+	}
+
+	if err := batchItems.enqueueAsync(job); err != nil {
+		// Some of the items may already be with the workers, so the job is kept around as failed
+		// for them to skip, rather than being left half sent
+		FailAsyncJob(redis, requestID, "Not all of the batch items could be sent to the workers.")
+		return "", err
+	}
+
+	return requestID, nil
+}
+
+// Get the kafka message for an item of an async batch job
+func asyncItemMessage(job AsyncJob, index int64, batchItem BatchItem) *sarama.ProducerMessage {
+	key, sequence := asyncMessageKey(job.Ordering, job.RequestID, job.IdentityID, batchItem)
+	asyncItem := AsyncBatchItem{
+		RequestID:  job.RequestID,
+		Index:      index,
+		Item:       batchItem,
+		IdentityID: job.IdentityID,
+		Sequence:   sequence,
+	}
+	return &sarama.ProducerMessage{
+		Topic: PriorityTopic(job.Priority),
+		Key:   sarama.ByteEncoder(key),
+		Value: sarama.ByteEncoder(encodeAsyncMessage(asyncItem, job.TraceContext)),
+	}
+}
+
+// Sends all of the batch items of an async batch job to kafka for the workers to process
+func (batchItems BatchItems) enqueueAsync(job AsyncJob) error {
+	messages := make([]*sarama.ProducerMessage, len(batchItems))
+	for idx, batchItem := range batchItems {
+		messages[idx] = asyncItemMessage(job, int64(idx), batchItem)
+	}
+	return sendAsyncItems(job, messages)
+}
+
+// Sends the item messages of an async batch job to kafka in bulk.  Any kafka didn't accept are
+// sent again, keeping the order of the items of ordered jobs.  Returns an error if some of them
+// still couldn't be sent.
+func sendAsyncItems(job AsyncJob, messages []*sarama.ProducerMessage) error {
+
+	producer, err := GetAsyncBatchProducer()
 	if err != nil {
-		log.Printf("An error occurred saving new request to Redis: [request id: %s] [Expire set?: %t] (error: %s)", requestID, expireResult, err)
+		return fmt.Errorf("An internal server error occurred.")
+	}
+
+	var failed []*sarama.ProducerMessage
+	if job.Ordering == OrderingPerJob || job.Ordering == OrderingPerResource {
+		failed, err = sendOrderedMessages(producer, messages)
 	} else {
-		log.Printf("Expiration on new async batch request successfully sent to redis: [request id: %s] [Expire set?: %t]", requestID, expireResult)
+		failed, err = sendMessages(producer, messages)
+	}
+	observeAsyncEnqueue(job.Priority, "sent", len(messages)-len(failed))
+	if err != nil {
+		observeAsyncEnqueue(job.Priority, "failed", len(failed))
+		log.Printf("An error occurred sending messages to Kafka: [request id: %s] [sent: %d] [failed: %d] (error: %s)", job.RequestID, len(messages)-len(failed), len(failed), err)
+		return fmt.Errorf("An internal server error occurred.")
 	}
 
-	return requestID, nil
+	log.Printf("Items successfully sent: [request id: %s] [items: %d]", job.RequestID, len(messages))
+	return nil
 }
@@ -0,0 +1,250 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"gopkg.in/redis.v2"
+)
+
+var BLOB_THRESHOLD int = 0
+var BLOB_STORE string = "local"
+var BLOB_DIR string = "/tmp/batch-blobs"
+var BLOB_INLINE bool = true
+var BLOB_CLEANUP_INTERVAL int = 600
+
+// Stores the response bodies of async batch items that are too large to keep in redis
+type BlobStore interface {
+	// Saves the response body of an item
+	Put(requestID string, index int64, data []byte) error
+	// Gets the response body of an item
+	Get(requestID string, index int64) ([]byte, error)
+	// Lists the request IDs that have response bodies saved
+	Requests() ([]string, error)
+	// Deletes all of the response bodies of a request
+	Delete(requestID string) error
+}
+
+// Where the body of an async batch item response was offloaded to, in place of the body
+type BlobRef struct {
+	Store string `json:"store"`
+	Size  int    `json:"size"`
+}
+
+// Get the blob store for async batch item response bodies
+var GetBlobStore = func() (BlobStore, error) {
+	switch BLOB_STORE {
+	case "local":
+		return LocalBlobStore{Dir: BLOB_DIR}, nil
+	}
+	return nil, fmt.Errorf("Unknown blob store: %s", BLOB_STORE)
+}
+
+// A blob store on the local filesystem, with a directory per request
+type LocalBlobStore struct {
+	Dir string
+}
+
+func (store LocalBlobStore) path(requestID string, index int64) string {
+	return filepath.Join(store.Dir, filepath.Base(requestID), strconv.FormatInt(index, 10)+".json")
+}
+
+func (store LocalBlobStore) Put(requestID string, index int64, data []byte) error {
+	path := store.path(requestID, index)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	// Written to a temporary file first, so a reader never sees half of a body
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (store LocalBlobStore) Get(requestID string, index int64) ([]byte, error) {
+	return ioutil.ReadFile(store.path(requestID, index))
+}
+
+func (store LocalBlobStore) Requests() ([]string, error) {
+	entries, err := ioutil.ReadDir(store.Dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	requestIDs := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			requestIDs = append(requestIDs, entry.Name())
+		}
+	}
+	return requestIDs, nil
+}
+
+func (store LocalBlobStore) Delete(requestID string) error {
+	return os.RemoveAll(filepath.Join(store.Dir, filepath.Base(requestID)))
+}
+
+// Get the URL the offloaded response body of an item can be downloaded from
+func AsyncItemBodyURL(requestID string, index int64) string {
+	return fmt.Sprintf("/batch/async/%s/items/%d/body", requestID, index)
+}
+
+// Converts an async batch item response to what's saved in redis.  Bodies larger than
+// BLOB_THRESHOLD bytes are saved to the blob store, and only a reference is kept in redis.
+func encodeAsyncResult(requestID string, index int64, response BatchResponseItem) (string, error) {
+	if BLOB_THRESHOLD > 0 {
+		body, _ := json.Marshal(response.Body)
+		if len(body) > BLOB_THRESHOLD {
+			store, err := GetBlobStore()
+			if err != nil {
+				return "", err
+			} else if err := store.Put(requestID, index, body); err != nil {
+				log.Printf("An error occurred saving batch item response body to the blob store: [request id: %s] [request index: %d] (error: %s)", requestID, index, err)
+				return "", err
+			}
+
+			response.Body = nil
+			response.BodyRef = &BlobRef{Store: BLOB_STORE, Size: len(body)}
+		}
+	}
+
+	output, _ := json.Marshal(response)
+	result, err := compressResult(output)
+	if err != nil {
+		log.Printf("An error occurred compressing batch item response: [request id: %s] [request index: %d] (error: %s)", requestID, index, err)
+		return "", err
+	}
+	return result, nil
+}
+
+// Reads an async batch item response saved in redis, without touching an offloaded body
+func unmarshalAsyncResult(requestID string, index int64, data string) (BatchResponseItem, error) {
+	output, err := decompressResult(data)
+	if err != nil {
+		log.Printf("An error occurred decompressing batch item response: [request id: %s] [request index: %d] (error: %s)", requestID, index, err)
+		return BatchResponseItem{}, fmt.Errorf("An internal server error occurred.")
+	}
+
+	var response BatchResponseItem
+	_ = json.Unmarshal(output, &response)
+	return response, nil
+}
+
+// Converts an async batch item response saved in redis back to the response.  An offloaded body
+// is put back in place when BLOB_INLINE is set, otherwise it is replaced with a link to download it.
+func decodeAsyncResult(requestID string, index int64, data string) (BatchResponseItem, error) {
+	response, err := unmarshalAsyncResult(requestID, index, data)
+	if err != nil {
+		return BatchResponseItem{}, err
+	} else if response.BodyRef == nil {
+		return response, nil
+	}
+
+	if !BLOB_INLINE {
+		response.BodyRef = nil
+		response.BodyURL = AsyncItemBodyURL(requestID, index)
+		return response, nil
+	}
+
+	body, err := readAsyncResultBody(requestID, index)
+	if err != nil {
+		return BatchResponseItem{}, err
+	}
+
+	response.BodyRef = nil
+	response.Body = json.RawMessage(body)
+	return response, nil
+}
+
+// Reads an offloaded response body from the blob store
+func readAsyncResultBody(requestID string, index int64) ([]byte, error) {
+	store, err := GetBlobStore()
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := store.Get(requestID, index)
+	if err != nil {
+		log.Printf("An error occurred reading batch item response body from the blob store: [request id: %s] [request index: %d] (error: %s)", requestID, index, err)
+		return nil, fmt.Errorf("An internal server error occurred.")
+	}
+	return body, nil
+}
+
+// Get the response body of a single async batch item of an identity, whether or not it was offloaded
+func RetrieveAsyncItemBody(identityID, requestID string, index int64) ([]byte, error) {
+	redis := GetAsyncJobRedis()
+	defer redis.Close()
+
+	if _, err := GetIdentityAsyncJob(redis, identityID, requestID); err != nil {
+		return nil, err
+	}
+
+	getCmd := redis.LIndex(requestID, index)
+	data, err := getCmd.Result()
+	if IsRedisNil(err) {
+		return nil, fmt.Errorf("The async batch request item can not be found.  It may have expired.")
+	} else if err != nil {
+		countRedisError("get_item")
+		log.Printf("An error occurred getting async batch request item from Redis: [request id: %s] [request index: %d] (error: %s)", requestID, index, err)
+		return nil, fmt.Errorf("An internal server error occurred.")
+	} else if data == "" {
+		return nil, fmt.Errorf("The async batch request item has not finished.")
+	}
+
+	response, err := unmarshalAsyncResult(requestID, index, data)
+	if err != nil {
+		return nil, err
+	} else if response.BodyRef != nil {
+		return readAsyncResultBody(requestID, index)
+	}
+
+	body, _ := json.Marshal(response.Body)
+	return body, nil
+}
+
+// Deletes the offloaded response bodies of requests that have expired from redis
+func cleanupBlobStore(redis *redis.Client) {
+	store, err := GetBlobStore()
+	if err != nil {
+		log.Printf("An error occurred getting the blob store: %s", err)
+		return
+	}
+
+	requestIDs, err := store.Requests()
+	if err != nil {
+		log.Printf("An error occurred listing the blob store: %s", err)
+		return
+	}
+
+	for _, requestID := range requestIDs {
+		existsCmd := redis.Exists(requestID)
+		if exists, err := existsCmd.Result(); err != nil || exists {
+			continue
+		}
+
+		if err := store.Delete(requestID); err != nil {
+			log.Printf("An error occurred deleting expired response bodies from the blob store: [request id: %s] (error: %s)", requestID, err)
+			continue
+		}
+		log.Printf("Deleted expired response bodies from the blob store: [request id: %s]", requestID)
+	}
+}
+
+// Get how often the blob store is cleaned up.  Zero if nothing is offloaded to it.
+func blobCleanupInterval() time.Duration {
+	if BLOB_THRESHOLD <= 0 {
+		return 0
+	}
+	return time.Duration(BLOB_CLEANUP_INTERVAL) * time.Second
+}
@@ -0,0 +1,71 @@
+package model
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestAsyncResultBlobOffload(t *testing.T) {
+	defer func(threshold int, dir string, inline bool) {
+		BLOB_THRESHOLD, BLOB_DIR, BLOB_INLINE = threshold, dir, inline
+	}(BLOB_THRESHOLD, BLOB_DIR, BLOB_INLINE)
+	BLOB_DIR = t.TempDir()
+
+	body := map[string]string{"message": strings.Repeat("x", 100)}
+	tests := []struct {
+		name      string
+		threshold int
+		inline    bool
+		offloaded bool
+		bodyURL   string
+	}{
+		{"offloading off", 0, true, false, ""},
+		{"smaller than the threshold", 1000, true, false, ""},
+		{"put back in place", 10, true, true, ""},
+		{"linked to", 10, false, true, AsyncItemBodyURL("request", 1)},
+	}
+
+	for _, test := range tests {
+		BLOB_THRESHOLD, BLOB_INLINE = test.threshold, test.inline
+		data, err := encodeAsyncResult("request", 1, BatchResponseItem{Code: 200, Body: body})
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+		if offloaded := strings.Contains(data, "bodyRef"); offloaded != test.offloaded {
+			t.Errorf("%s: offloaded %t, expected %t", test.name, offloaded, test.offloaded)
+		}
+
+		response, err := decodeAsyncResult("request", 1, data)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		} else if response.BodyURL != test.bodyURL || response.BodyRef != nil {
+			t.Errorf("%s: got body URL %q and ref %v, expected %q", test.name, response.BodyURL, response.BodyRef, test.bodyURL)
+		} else if test.bodyURL == "" {
+			output, _ := json.Marshal(response.Body)
+			expected, _ := json.Marshal(body)
+			if string(output) != string(expected) {
+				t.Errorf("%s: got body %s, expected %s", test.name, output, expected)
+			}
+		}
+	}
+}
+
+func TestRetrieveAsyncItemBody(t *testing.T) {
+	redis := testRedis(t)
+	defer redis.Close()
+
+	requestID := testAsyncJob(t, redis, AsyncJobComplete, `{"code":200,"body":{"id":1}}`)
+
+	if body, err := RetrieveAsyncItemBody("identity", requestID, 0); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	} else if string(body) != `{"id":1}` {
+		t.Errorf("Got body %s", body)
+	}
+
+	// Another identity can't tell the request exists
+	if _, err := RetrieveAsyncItemBody("other", requestID, 0); err == nil || !strings.Contains(err.Error(), "can not be found") {
+		t.Errorf("Expected the request not to be found for another identity, got %v", err)
+	}
+}
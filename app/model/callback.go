@@ -0,0 +1,270 @@
+package model
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"gopkg.in/redis.v2"
+)
+
+var CALLBACK_RETRIES int = 5
+var CALLBACK_BACKOFF int = 1000
+var CALLBACK_TIMEOUT int = 10
+var CALLBACK_MAX_RESULTS int64 = 100
+var CALLBACK_ALLOWED_HOSTS string = ""
+
+// The sorted set of async batch jobs with a callback to deliver, scored by the unix time of the next attempt
+const asyncCallbacksKey = "batch:callbacks"
+
+// The body posted to the callback URL of an async batch job when it completes
+type AsyncCallbackPayload struct {
+	RequestID string        `json:"requestId"`
+	Status    string        `json:"status"`
+	Total     int64         `json:"total"`
+	Location  string        `json:"location"`
+	Results   BatchResponse `json:"results,omitempty"`
+}
+
+// Get the client to use for the callback requests.  Unless CALLBACK_ALLOWED_HOSTS is set, it won't
+// connect to internal addresses, checked after the host is resolved, and it doesn't follow redirects.
+var GetCallbackClient = func() BatchClient {
+	transport := &http.Transport{TLSHandshakeTimeout: 10 * time.Second}
+	if callbackAllowedHosts() == nil {
+		dialer := &net.Dialer{Timeout: 30 * time.Second, Control: checkCallbackAddress}
+		transport.DialContext = dialer.DialContext
+	}
+
+	return &http.Client{
+		Timeout:   time.Duration(CALLBACK_TIMEOUT) * time.Second,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// Get the hosts callbacks can be sent to, from CALLBACK_ALLOWED_HOSTS.  Nil if any public host is allowed.
+func callbackAllowedHosts() map[string]bool {
+	if strings.TrimSpace(CALLBACK_ALLOWED_HOSTS) == "" {
+		return nil
+	}
+
+	hosts := map[string]bool{}
+	for _, host := range strings.Split(CALLBACK_ALLOWED_HOSTS, ",") {
+		hosts[strings.ToLower(strings.TrimSpace(host))] = true
+	}
+	return hosts
+}
+
+// Checks that a callback URL can be delivered to.  It has to be https, and to one of
+// CALLBACK_ALLOWED_HOSTS if that is set.  Otherwise it can't be to an internal address.
+func ValidateCallbackURL(callbackURL string) error {
+	parsed, err := url.Parse(callbackURL)
+	if err != nil || parsed.Scheme != "https" || parsed.Hostname() == "" {
+		return fmt.Errorf("Invalid callbackUrl, it must be an https URL: %s", callbackURL)
+	}
+
+	host := strings.ToLower(parsed.Hostname())
+	if allowed := callbackAllowedHosts(); allowed != nil {
+		if !allowed[host] {
+			return fmt.Errorf("Invalid callbackUrl, the host isn't allowed: %s", callbackURL)
+		}
+	} else if ip := net.ParseIP(host); (ip != nil && !publicAddress(ip)) || host == "localhost" {
+		return fmt.Errorf("Invalid callbackUrl, the host isn't allowed: %s", callbackURL)
+	}
+	return nil
+}
+
+// Checks whether an IP address is on the public internet, rather than private, loopback or link local
+func publicAddress(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast())
+}
+
+// Stops a callback from connecting to an internal address.  This runs after the host is resolved,
+// so a public host name that resolves to an internal address is stopped too.
+func checkCallbackAddress(network, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicAddress(ip) {
+		return fmt.Errorf("Callbacks can't be sent to internal addresses: %s", host)
+	}
+	return nil
+}
+
+// Signs the callback body with the job's secret, so the receiver can verify it came from us
+func SignCallback(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Builds the callback body for a job.  Small jobs get their results inline, large jobs only get a summary.
+func newAsyncCallbackPayload(job AsyncJob) AsyncCallbackPayload {
+	payload := AsyncCallbackPayload{
+		RequestID: job.RequestID,
+		Status:    job.Status,
+		Total:     job.Total,
+		Location:  "/batch/async/" + job.RequestID,
+	}
+
+	if job.Total <= CALLBACK_MAX_RESULTS {
+		results, err := RetrieveAsyncResponse(job.RequestID)
+		if err != nil {
+			log.Printf("An error occurred getting results for async callback. Sending summary only: [request id: %s] (error: %s)", job.RequestID, err)
+		} else {
+			payload.Results = results
+		}
+	}
+
+	return payload
+}
+
+// Makes a single attempt at delivering a callback.  retry is false if the receiver rejected it outright.
+func sendAsyncCallback(job AsyncJob, body []byte) (code int, retry bool, err error) {
+	// Checked again in case the allowed hosts changed since the job was created
+	if err := ValidateCallbackURL(job.CallbackURL); err != nil {
+		return 0, false, err
+	}
+
+	request, err := http.NewRequest("POST", job.CallbackURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, false, fmt.Errorf("Invalid callback URL: %s", err)
+	}
+
+	for header, val := range job.CallbackHeaders {
+		request.Header.Set(header, val)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Batch-Request-Id", job.RequestID)
+	if job.CallbackSecret != "" {
+		request.Header.Set("X-Batch-Signature", SignCallback(job.CallbackSecret, body))
+	}
+
+	response, err := GetCallbackClient().Do(request)
+	if err != nil {
+		return 0, true, err
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, response.Body)
+
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return response.StatusCode, false, nil
+	}
+
+	retry = response.StatusCode >= 500 || response.StatusCode == http.StatusTooManyRequests
+	return response.StatusCode, retry, fmt.Errorf("Callback responded with status %d", response.StatusCode)
+}
+
+// Makes the next attempt at delivering the callback of a completed async batch job.  Failed
+// attempts are rescheduled with an exponential backoff rather than waited on, so callbacks that
+// are still pending survive restarts.  The delivery status is recorded on the job.
+func DeliverAsyncCallback(redis *redis.Client, requestID string) error {
+	job, err := GetAsyncJob(redis, requestID)
+	if err != nil || job.CallbackURL == "" {
+		// The job expired or was purged, so there's nothing left to deliver
+		unscheduleAsyncCallback(redis, requestID)
+		return err
+	}
+
+	body, err := json.Marshal(newAsyncCallbackPayload(job))
+	if err != nil {
+		log.Printf("An error occurred creating async callback body: [request id: %s] (error: %s)", requestID, err)
+		return err
+	}
+
+	attempts := job.CallbackAttempts + 1
+	code, retry, err := sendAsyncCallback(job, body)
+	if err != nil && retry && attempts <= int64(CALLBACK_RETRIES) {
+		backoff := time.Duration(CALLBACK_BACKOFF) * time.Millisecond << uint(attempts-1)
+		log.Printf("An error occurred delivering async callback. Retrying in %s: [request id: %s] [url: %s] [attempt: %d] (error: %s)", backoff, requestID, job.CallbackURL, attempts, err)
+		UpdateAsyncJob(redis, requestID,
+			"callbackAttempts", strconv.FormatInt(attempts, 10),
+			"callbackCode", strconv.Itoa(code),
+			"callbackError", err.Error())
+		return scheduleAsyncCallback(redis, requestID, time.Now().Add(backoff))
+	}
+
+	status, callbackError := CallbackDelivered, ""
+	if err != nil {
+		log.Printf("An error occurred delivering async callback. Giving up: [request id: %s] [url: %s] [attempt: %d] (error: %s)", requestID, job.CallbackURL, attempts, err)
+		status, callbackError = CallbackFailed, err.Error()
+	} else {
+		log.Printf("Successfully delivered async callback: [request id: %s] [url: %s] [attempts: %d] (code: %d)", requestID, job.CallbackURL, attempts, code)
+	}
+
+	UpdateAsyncJob(redis, requestID,
+		"callbackStatus", status,
+		"callbackAttempts", strconv.FormatInt(attempts, 10),
+		"callbackCode", strconv.Itoa(code),
+		"callbackError", callbackError,
+		"callbackAt", time.Now().Format(time.RFC3339Nano))
+	unscheduleAsyncCallback(redis, requestID)
+
+	return err
+}
+
+// Schedules the next attempt at delivering the callback of an async batch job
+func scheduleAsyncCallback(redis *redis.Client, requestID string, at time.Time) error {
+	scheduleCmd := redis.ZAdd(asyncCallbacksKey, redisZ(float64(at.Unix()), requestID))
+	if _, err := scheduleCmd.Result(); err != nil {
+		countRedisError("schedule_callback")
+		log.Printf("An error occurred scheduling async callback in Redis: [request id: %s] (error: %s)", requestID, err)
+		return err
+	}
+	return nil
+}
+
+// Removes the callback of an async batch job from the pending callbacks
+func unscheduleAsyncCallback(redis *redis.Client, requestID string) {
+	remCmd := redis.ZRem(asyncCallbacksKey, requestID)
+	if _, err := remCmd.Result(); err != nil {
+		log.Printf("An error occurred removing async callback from the pending callbacks: [request id: %s] (error: %s)", requestID, err)
+	}
+}
+
+// Delivers the pending callbacks that are due.  Each is claimed for SCHEDULER_LEASE seconds
+// first, so if the worker dies while delivering it, it's tried again once the lease runs out.
+func runPendingCallbacks(redis *redis.Client) {
+	now := time.Now()
+	lease := now.Add(time.Duration(SCHEDULER_LEASE) * time.Second)
+
+	claimCmd := redis.Eval(claimScheduledScript, []string{asyncCallbacksKey}, []string{
+		strconv.FormatInt(now.Unix(), 10),
+		strconv.FormatInt(lease.Unix(), 10),
+		strconv.FormatInt(SCHEDULER_BATCH, 10),
+	})
+	claimResult, err := claimCmd.Result()
+	if err != nil {
+		countRedisError("claim_callback")
+		log.Printf("An error occurred claiming pending async callbacks: %s", err)
+		return
+	}
+
+	// Callbacks are delivered in the background, so a slow receiver doesn't hold up the scheduler
+	due, _ := claimResult.([]interface{})
+	for _, requestID := range due {
+		requestID, _ := requestID.(string)
+		go func() {
+			redis := GetAsyncJobRedis()
+			defer redis.Close()
+			DeliverAsyncCallback(redis, requestID)
+		}()
+	}
+}
@@ -0,0 +1,165 @@
+package model
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A callback client that answers every request with the same status, and counts the requests
+type testCallbackClient struct {
+	code     int
+	err      error
+	requests int
+}
+
+func (client *testCallbackClient) Do(req *http.Request) (*http.Response, error) {
+	client.requests++
+	if client.err != nil {
+		return nil, client.err
+	}
+	return &http.Response{StatusCode: client.code, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+}
+
+// Replaces the callback client for the test
+func useTestCallbackClient(t *testing.T, client *testCallbackClient) {
+	getCallbackClient := GetCallbackClient
+	GetCallbackClient = func() BatchClient {
+		return client
+	}
+	t.Cleanup(func() {
+		GetCallbackClient = getCallbackClient
+	})
+}
+
+func TestValidateCallbackURL(t *testing.T) {
+	defer func(allowed string) {
+		CALLBACK_ALLOWED_HOSTS = allowed
+	}(CALLBACK_ALLOWED_HOSTS)
+
+	tests := []struct {
+		name    string
+		allowed string
+		url     string
+		valid   bool
+	}{
+		{"public host", "", "https://hooks.example.com/done", true},
+		{"public address", "", "https://8.8.8.8/done", true},
+		{"http", "", "http://hooks.example.com/done", false},
+		{"no host", "", "https:///done", false},
+		{"localhost", "", "https://localhost/done", false},
+		{"loopback", "", "https://127.0.0.1/done", false},
+		{"private", "", "https://10.1.2.3/done", false},
+		{"link local", "", "https://169.254.169.254/latest/meta-data", false},
+		{"ipv6 loopback", "", "https://[::1]/done", false},
+		{"allowed host", "hooks.example.com, other.example.com", "https://Hooks.Example.com/done", true},
+		{"host not allowed", "hooks.example.com", "https://evil.example.com/done", false},
+	}
+
+	for _, test := range tests {
+		CALLBACK_ALLOWED_HOSTS = test.allowed
+		if err := ValidateCallbackURL(test.url); (err == nil) != test.valid {
+			t.Errorf("%s: valid %t, expected %t (error: %v)", test.name, err == nil, test.valid, err)
+		}
+	}
+}
+
+func TestCheckCallbackAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		allowed bool
+	}{
+		{"93.184.216.34:443", true},
+		{"127.0.0.1:443", false},
+		{"192.168.1.10:443", false},
+		{"[fe80::1]:443", false},
+		{"0.0.0.0:443", false},
+	}
+
+	for _, test := range tests {
+		if err := checkCallbackAddress("tcp", test.address, nil); (err == nil) != test.allowed {
+			t.Errorf("%s: allowed %t, expected %t", test.address, err == nil, test.allowed)
+		}
+	}
+
+	if publicAddress(net.ParseIP("172.16.0.1")) {
+		t.Errorf("Expected 172.16.0.1 to be private")
+	}
+}
+
+func TestSendAsyncCallback(t *testing.T) {
+	job := AsyncJob{RequestID: "request", CallbackURL: "https://hooks.example.com/done"}
+
+	tests := []struct {
+		name  string
+		code  int
+		err   error
+		retry bool
+		ok    bool
+	}{
+		{"delivered", 204, nil, false, true},
+		{"server error", 503, nil, true, false},
+		{"rate limited", 429, nil, true, false},
+		{"rejected", 400, nil, false, false},
+		{"connection failed", 0, fmt.Errorf("connection refused"), true, false},
+	}
+
+	for _, test := range tests {
+		useTestCallbackClient(t, &testCallbackClient{code: test.code, err: test.err})
+		_, retry, err := sendAsyncCallback(job, []byte(`{}`))
+		if (err == nil) != test.ok || retry != test.retry {
+			t.Errorf("%s: got retry %t (error: %v), expected retry %t and ok %t", test.name, retry, err, test.retry, test.ok)
+		}
+	}
+
+	// An internal callback URL is never requested
+	client := &testCallbackClient{code: 200}
+	useTestCallbackClient(t, client)
+	internal := AsyncJob{RequestID: "request", CallbackURL: "https://127.0.0.1/done"}
+	if _, retry, err := sendAsyncCallback(internal, []byte(`{}`)); err == nil || retry || client.requests != 0 {
+		t.Errorf("Expected the internal callback to be refused without a retry, got retry %t (error: %v)", retry, err)
+	}
+}
+
+func TestDeliverAsyncCallbackRetries(t *testing.T) {
+	redis := testRedis(t)
+	defer redis.Close()
+
+	defer func(retries, backoff int) {
+		CALLBACK_RETRIES, CALLBACK_BACKOFF = retries, backoff
+	}(CALLBACK_RETRIES, CALLBACK_BACKOFF)
+	CALLBACK_RETRIES, CALLBACK_BACKOFF = 2, 60000
+
+	requestID := testAsyncJob(t, redis, AsyncJobComplete, `{"code":200}`)
+	redis.HSet(AsyncJobKey(requestID), "callbackUrl", "https://hooks.example.com/done")
+	t.Cleanup(func() {
+		unscheduleAsyncCallback(redis, requestID)
+	})
+	useTestCallbackClient(t, &testCallbackClient{code: 503})
+
+	// Each failed attempt is rescheduled, backing off for twice as long as the last
+	for attempt, backoff := range []time.Duration{time.Minute, 2 * time.Minute} {
+		if err := DeliverAsyncCallback(redis, requestID); err != nil {
+			t.Fatalf("Attempt %d: unexpected error: %s", attempt+1, err)
+		}
+		at, err := redis.ZScore(asyncCallbacksKey, requestID).Result()
+		if expected := time.Now().Add(backoff).Unix(); err != nil || at < float64(expected-5) || at > float64(expected+5) {
+			t.Errorf("Attempt %d: expected the callback to be rescheduled in %s, got %f (error: %v)", attempt+1, backoff, at, err)
+		}
+	}
+
+	// Once the retries run out it's given up on
+	if err := DeliverAsyncCallback(redis, requestID); err == nil {
+		t.Errorf("Expected the last attempt to fail")
+	}
+	if status, _ := redis.HGet(AsyncJobKey(requestID), "callbackStatus").Result(); status != CallbackFailed {
+		t.Errorf("Expected the callback to have failed, got %q", status)
+	}
+	if _, err := redis.ZScore(asyncCallbacksKey, requestID).Result(); !IsRedisNil(err) {
+		t.Errorf("Expected the failed callback not to be pending")
+	}
+}
@@ -0,0 +1,264 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/pborman/uuid"
+	"gopkg.in/redis.v2"
+)
+
+var ASYNC_ITEM_LEASE int = 30000
+var ASYNC_ITEM_LEASE_POLL int = 500
+var ASYNC_ITEM_LEASE_RENEW int = 10000
+
+// Claims an item of an async batch job for a holder.  The lease is only given out if the item
+// has no result and nobody else holds it.  Returns "done" if the item already has a result, nil
+// if another holder has the lease, the previous holder if an expired lease was taken over, or
+// "" otherwise.  Take-overs are recorded in the job's takeovers list, and counted on the job.
+const claimItemScript = `
+local result = redis.call("LINDEX", KEYS[1], ARGV[1])
+if not result then
+	return "expired"
+elseif result ~= "" then
+	return "done"
+end
+if not redis.call("SET", KEYS[2], ARGV[2], "NX", "PX", ARGV[3]) then
+	return nil
+end
+local previous = redis.call("HGET", KEYS[3], ARGV[1])
+redis.call("HSET", KEYS[3], ARGV[1], ARGV[2])
+if previous then
+	redis.call("RPUSH", KEYS[4], cjson.encode({idx = tonumber(ARGV[1]), previous = previous, holder = ARGV[2], at = ARGV[4]}))
+	redis.call("HINCRBY", KEYS[5], "takeovers", 1)
+end
+local ttl = redis.call("PTTL", KEYS[1])
+if ttl > 0 then
+	redis.call("PEXPIRE", KEYS[3], ttl)
+	redis.call("PEXPIRE", KEYS[4], ttl)
+end
+return previous or ""
+`
+
+// Saves the result of an item, only if the holder's claim on it wasn't taken over, and counts it
+// as completed on the job in the same step.  Returns 1 if the result was saved, 2 if it was also
+// the job's last item, 0 if the claim was taken over, and -1 if the item already has a result.
+// The job becomes complete with its last item unless it was cancelled, and its keys, from
+// KEYS[7] on, are kept for another ARGV[4] seconds while it's making progress, or for its result
+// TTL, defaulting to ARGV[6] seconds, once it's complete.  Cancelled jobs keep the expiration
+// they were cancelled with.  If the job has a callback, it's added to the pending callbacks in
+// KEYS[6] with its last item, to be delivered at ARGV[7].
+const completeItemScript = `
+if redis.call("HGET", KEYS[3], ARGV[1]) ~= ARGV[2] then
+	return 0
+elseif redis.call("LINDEX", KEYS[1], ARGV[1]) ~= "" then
+	return -1
+end
+redis.call("LSET", KEYS[1], ARGV[1], ARGV[3])
+redis.call("DEL", KEYS[2])
+if redis.call("EXISTS", KEYS[5]) == 0 then
+	return 1
+end
+local completed = redis.call("HINCRBY", KEYS[5], "completed", 1)
+local finished = completed == tonumber(redis.call("HGET", KEYS[5], "total"))
+if redis.call("HGET", KEYS[5], "status") ~= "cancelled" then
+	local expire = ARGV[4]
+	if finished then
+		redis.call("HSET", KEYS[5], "status", "complete")
+		redis.call("HSET", KEYS[5], "completedAt", ARGV[5])
+		expire = tonumber(redis.call("HGET", KEYS[5], "resultTtl") or "0") or 0
+		if expire <= 0 then
+			expire = ARGV[6]
+		end
+	end
+	for i = 7, #KEYS do
+		redis.call("EXPIRE", KEYS[i], expire)
+	end
+end
+if not finished then
+	return 1
+end
+local callbackURL = redis.call("HGET", KEYS[5], "callbackUrl")
+if callbackURL and callbackURL ~= "" then
+	redis.call("HSET", KEYS[5], "callbackAttempts", 0)
+	redis.call("ZADD", KEYS[6], ARGV[7], KEYS[1])
+end
+return 2
+`
+
+// Gives up a claim so the item can be claimed again right away
+const releaseItemScript = `
+if redis.call("HGET", KEYS[3], ARGV[1]) == ARGV[2] then
+	redis.call("HDEL", KEYS[3], ARGV[1])
+	if redis.call("GET", KEYS[2]) == ARGV[2] then
+		redis.call("DEL", KEYS[2])
+	end
+end
+return 1
+`
+
+// Extends the lease on an item for another ARGV[2] milliseconds, only if the holder still has it.
+// Returns 1 if the lease was extended, and 0 if it ran out or was taken over.
+const renewItemScript = `
+if redis.call("GET", KEYS[2]) ~= ARGV[1] then
+	return 0
+end
+redis.call("PEXPIRE", KEYS[2], ARGV[2])
+return 1
+`
+
+// A worker's claim on an item of an async batch job
+type asyncItemClaim struct {
+	RequestID string
+	Index     int64
+	Holder    string
+}
+
+// Get the redis key holding the lease on an item of an async batch job
+func AsyncJobClaimKey(requestID string, index int64) string {
+	return fmt.Sprintf("%s:claim:%d", requestID, index)
+}
+
+// Get the redis key holding the last holder of the claim on each item of an async batch job
+func AsyncJobClaimsKey(requestID string) string {
+	return requestID + ":claims"
+}
+
+// Get the redis key holding the take-overs of claims on the items of an async batch job
+func AsyncJobTakeoversKey(requestID string) string {
+	return requestID + ":takeovers"
+}
+
+func (claim asyncItemClaim) keys() []string {
+	return []string{
+		claim.RequestID,
+		AsyncJobClaimKey(claim.RequestID, claim.Index),
+		AsyncJobClaimsKey(claim.RequestID),
+		AsyncJobTakeoversKey(claim.RequestID),
+		AsyncJobKey(claim.RequestID),
+	}
+}
+
+// Claims an item of an async batch job so only this worker executes it.  While another worker holds
+// the lease this waits for it to finish, or for the lease to expire and be taken over.  Returns
+// false if the item doesn't need to be executed because it already has a result or has expired.
+func claimAsyncItem(ctx context.Context, redis *redis.Client, requestID string, index int64) (asyncItemClaim, bool, error) {
+	claim := asyncItemClaim{
+		RequestID: requestID,
+		Index:     index,
+		Holder:    InstanceID + "/" + uuid.New(),
+	}
+	lease := strconv.Itoa(ASYNC_ITEM_LEASE)
+
+	for {
+		now := time.Now().Format(time.RFC3339Nano)
+		claimCmd := redis.Eval(claimItemScript, claim.keys(), []string{strconv.FormatInt(index, 10), claim.Holder, lease, now})
+		claimResult, err := claimCmd.Result()
+		if IsRedisNil(err) {
+			log.Printf("Batch item is claimed by another worker. Waiting: [request id: %s] [request index: %d]", requestID, index)
+			select {
+			case <-ctx.Done():
+				return claim, false, ctx.Err()
+			case <-time.After(time.Duration(ASYNC_ITEM_LEASE_POLL) * time.Millisecond):
+			}
+			continue
+		} else if err != nil {
+			countRedisError("claim_item")
+			log.Printf("An error occurred claiming batch item in Redis: [request id: %s] [request index: %d] (error: %s)", requestID, index, err)
+			return claim, false, err
+		}
+
+		switch previous, _ := claimResult.(string); previous {
+		case "done":
+			log.Printf("Batch Item already processed: [request id: %s] [request index: %d]", requestID, index)
+			return claim, false, nil
+		case "expired":
+			log.Printf("Batch Item request not found. It may have expired: [request id: %s] [request index: %d]", requestID, index)
+			return claim, false, nil
+		case "":
+		default:
+			log.Printf("Took over expired claim on batch item: [request id: %s] [request index: %d] [previous: %s] [holder: %s]", requestID, index, previous, claim.Holder)
+		}
+
+		return claim, true, nil
+	}
+}
+
+// Saves the result of a claimed item, and counts it as completed on the job.  Returns false if the
+// claim was taken over by another worker, which will save its own result, and finished true if
+// this was the job's last item, in which case its callback is already pending.
+func (claim asyncItemClaim) Complete(redis *redis.Client, result string) (saved bool, finished bool, err error) {
+	now := time.Now()
+	keys := append(claim.keys(), asyncCallbacksKey)
+	keys = append(keys, AsyncJobKeys(claim.RequestID)...)
+	completeCmd := redis.Eval(completeItemScript, keys, []string{
+		strconv.FormatInt(claim.Index, 10),
+		claim.Holder,
+		result,
+		strconv.Itoa(ASYNC_EXPIRE * 60),
+		now.Format(time.RFC3339Nano),
+		strconv.Itoa(ASYNC_EXPIRE * 60),
+		strconv.FormatInt(now.Unix(), 10),
+	})
+	completeResult, err := completeCmd.Result()
+	if err != nil {
+		return false, false, err
+	}
+
+	switch completed, _ := completeResult.(int64); completed {
+	case 1:
+		return true, false, nil
+	case 2:
+		return true, true, nil
+	}
+	log.Printf("Batch item result discarded, the claim was taken over or the item already has a result: [request id: %s] [request index: %d] [holder: %s]", claim.RequestID, claim.Index, claim.Holder)
+	return false, false, nil
+}
+
+// Extends the lease on the item by ASYNC_ITEM_LEASE.  Returns false if the lease was already lost.
+func (claim asyncItemClaim) Renew(redis *redis.Client) (bool, error) {
+	renewCmd := redis.Eval(renewItemScript, claim.keys(), []string{claim.Holder, strconv.Itoa(ASYNC_ITEM_LEASE)})
+	renewResult, err := renewCmd.Result()
+	if err != nil {
+		return false, err
+	}
+	renewed, _ := renewResult.(int64)
+	return renewed == 1, nil
+}
+
+// Renews the lease on the item every ASYNC_ITEM_LEASE_RENEW milliseconds until done is closed, so
+// the item isn't taken over while a slow request is still running.  Stops early if the lease was
+// lost.
+func (claim asyncItemClaim) KeepAlive(redis *redis.Client, done <-chan bool) {
+	ticker := time.NewTicker(time.Duration(ASYNC_ITEM_LEASE_RENEW) * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		renewed, err := claim.Renew(redis)
+		if err != nil {
+			countRedisError("renew_item")
+			log.Printf("An error occurred renewing claim on batch item in Redis: [request id: %s] [request index: %d] (error: %s)", claim.RequestID, claim.Index, err)
+		} else if !renewed {
+			log.Printf("Claim on batch item was lost while it was running: [request id: %s] [request index: %d] [holder: %s]", claim.RequestID, claim.Index, claim.Holder)
+			return
+		}
+	}
+}
+
+// Gives up a claim on an item that couldn't be processed, so a retry doesn't count as a take-over
+func (claim asyncItemClaim) Release(redis *redis.Client) {
+	releaseCmd := redis.Eval(releaseItemScript, claim.keys(), []string{strconv.FormatInt(claim.Index, 10), claim.Holder})
+	if _, err := releaseCmd.Result(); err != nil {
+		countRedisError("release_item")
+		log.Printf("An error occurred releasing claim on batch item in Redis: [request id: %s] [request index: %d] (error: %s)", claim.RequestID, claim.Index, err)
+	}
+}
@@ -0,0 +1,205 @@
+package model
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pborman/uuid"
+	"gopkg.in/redis.v2"
+)
+
+// Get a redis client for the tests, skipping the test if redis can't be reached
+func testRedis(t *testing.T) *redis.Client {
+	redis := GetAsyncJobRedis()
+	if _, err := redis.Ping().Result(); err != nil {
+		redis.Close()
+		t.Skipf("Redis is not reachable at %s:%s: %s", REDIS_HOST, REDIS_PORT, err)
+	}
+	return redis
+}
+
+// Saves an async batch job with the results given, where "" is an item that isn't done yet.
+// Returns its request ID.  The job is deleted when the test finishes.
+func testAsyncJob(t *testing.T, redis *redis.Client, status string, results ...string) string {
+	requestID := "test:" + uuid.New()
+	completed := int64(0)
+	for _, result := range results {
+		if result != "" {
+			completed++
+		}
+	}
+
+	job := AsyncJob{
+		RequestID:  requestID,
+		IdentityID: "identity",
+		Status:     status,
+		Total:      int64(len(results)),
+		Completed:  completed,
+		Created:    time.Now(),
+	}
+	if err := SaveAsyncJob(redis, job); err != nil {
+		t.Fatalf("Unable to save the async job: %s", err)
+	} else if _, err := redis.RPush(requestID, results...).Result(); err != nil {
+		t.Fatalf("Unable to save the async results: %s", err)
+	}
+
+	t.Cleanup(func() {
+		keys := AsyncJobKeys(requestID)
+		for idx := range results {
+			keys = append(keys, AsyncJobClaimKey(requestID, int64(idx)))
+		}
+		redis.Del(keys...)
+	})
+	return requestID
+}
+
+func TestClaimAsyncItem(t *testing.T) {
+	redis := testRedis(t)
+	defer redis.Close()
+
+	requestID := testAsyncJob(t, redis, AsyncJobPending, "", "done")
+
+	tests := []struct {
+		name    string
+		index   int64
+		claimed bool
+	}{
+		{"pending item", 0, true},
+		{"item with a result", 1, false},
+		{"item past the end", 2, false},
+	}
+	for _, test := range tests {
+		_, claimed, err := claimAsyncItem(context.Background(), redis, requestID, test.index)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		} else if claimed != test.claimed {
+			t.Errorf("%s: claimed %t, expected %t", test.name, claimed, test.claimed)
+		}
+	}
+
+	// While the lease is held the claim waits until it's given up on
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, claimed, err := claimAsyncItem(ctx, redis, requestID, 0); claimed || err == nil {
+		t.Errorf("Expected a held claim to wait until cancelled, got claimed %t (error: %v)", claimed, err)
+	}
+}
+
+func TestClaimAsyncItemTakeOver(t *testing.T) {
+	redis := testRedis(t)
+	defer redis.Close()
+
+	requestID := testAsyncJob(t, redis, AsyncJobPending, "")
+
+	first, claimed, err := claimAsyncItem(context.Background(), redis, requestID, 0)
+	if err != nil || !claimed {
+		t.Fatalf("Expected the item to be claimed, got claimed %t (error: %v)", claimed, err)
+	}
+
+	// The lease expiring lets another worker take it over
+	redis.Del(AsyncJobClaimKey(requestID, 0))
+	second, claimed, err := claimAsyncItem(context.Background(), redis, requestID, 0)
+	if err != nil || !claimed {
+		t.Fatalf("Expected the expired claim to be taken over, got claimed %t (error: %v)", claimed, err)
+	} else if second.Holder == first.Holder {
+		t.Fatalf("Expected a new holder to take over the claim")
+	}
+
+	if takeovers, _ := redis.LLen(AsyncJobTakeoversKey(requestID)).Result(); takeovers != 1 {
+		t.Errorf("Expected 1 take-over to be recorded, got %d", takeovers)
+	}
+	if takeovers, _ := redis.HGet(AsyncJobKey(requestID), "takeovers").Result(); takeovers != "1" {
+		t.Errorf("Expected the job to count 1 take-over, got %q", takeovers)
+	}
+
+	// Only the holder that took it over can save a result
+	if saved, _, err := first.Complete(redis, "first"); err != nil || saved {
+		t.Errorf("Expected the taken over claim not to save a result, got saved %t (error: %v)", saved, err)
+	}
+	if saved, _, err := second.Complete(redis, "second"); err != nil || !saved {
+		t.Errorf("Expected the new holder to save its result, got saved %t (error: %v)", saved, err)
+	}
+	if result, _ := redis.LIndex(requestID, 0).Result(); result != "second" {
+		t.Errorf("Expected the new holder's result to be saved, got %q", result)
+	}
+}
+
+func TestCompleteAsyncItem(t *testing.T) {
+	redis := testRedis(t)
+	defer redis.Close()
+
+	requestID := testAsyncJob(t, redis, AsyncJobPending, "", "")
+
+	tests := []struct {
+		name     string
+		index    int64
+		finished bool
+		status   string
+	}{
+		{"first item", 0, false, AsyncJobPending},
+		{"last item", 1, true, AsyncJobComplete},
+	}
+	for idx, test := range tests {
+		claim, claimed, err := claimAsyncItem(context.Background(), redis, requestID, test.index)
+		if err != nil || !claimed {
+			t.Fatalf("%s: expected the item to be claimed, got claimed %t (error: %v)", test.name, claimed, err)
+		}
+
+		saved, finished, err := claim.Complete(redis, test.name)
+		if err != nil || !saved {
+			t.Fatalf("%s: expected the result to be saved, got saved %t (error: %v)", test.name, saved, err)
+		} else if finished != test.finished {
+			t.Errorf("%s: finished %t, expected %t", test.name, finished, test.finished)
+		}
+
+		job, err := GetAsyncJob(redis, requestID)
+		if err != nil {
+			t.Fatalf("%s: unable to get the job: %s", test.name, err)
+		} else if job.Completed != int64(idx+1) {
+			t.Errorf("%s: %d items completed, expected %d", test.name, job.Completed, idx+1)
+		} else if job.Status != test.status {
+			t.Errorf("%s: status %s, expected %s", test.name, job.Status, test.status)
+		}
+
+		if exists, _ := redis.Exists(AsyncJobClaimKey(requestID, test.index)).Result(); exists {
+			t.Errorf("%s: expected the lease to be given up with the result saved", test.name)
+		}
+
+		// Saving it twice doesn't count it twice
+		if saved, _, err := claim.Complete(redis, test.name); err != nil || saved {
+			t.Errorf("%s: expected a second result not to be saved, got saved %t (error: %v)", test.name, saved, err)
+		}
+	}
+}
+
+func TestKeepAliveAsyncItem(t *testing.T) {
+	redis := testRedis(t)
+	defer redis.Close()
+
+	defer func(lease, renew int) {
+		ASYNC_ITEM_LEASE, ASYNC_ITEM_LEASE_RENEW = lease, renew
+	}(ASYNC_ITEM_LEASE, ASYNC_ITEM_LEASE_RENEW)
+	ASYNC_ITEM_LEASE, ASYNC_ITEM_LEASE_RENEW = 200, 50
+
+	requestID := testAsyncJob(t, redis, AsyncJobPending, "")
+	claim, claimed, err := claimAsyncItem(context.Background(), redis, requestID, 0)
+	if err != nil || !claimed {
+		t.Fatalf("Expected the item to be claimed, got claimed %t (error: %v)", claimed, err)
+	}
+
+	// The lease outlives its length while it's kept alive
+	done := make(chan bool)
+	go claim.KeepAlive(redis, done)
+	time.Sleep(500 * time.Millisecond)
+	close(done)
+	if holder, _ := redis.Get(AsyncJobClaimKey(requestID, 0)).Result(); holder != claim.Holder {
+		t.Errorf("Expected the lease to be renewed, got holder %q", holder)
+	}
+
+	// A lease that was taken over isn't renewed
+	redis.Set(AsyncJobClaimKey(requestID, 0), "other")
+	if renewed, err := claim.Renew(redis); err != nil || renewed {
+		t.Errorf("Expected a lost lease not to be renewed, got renewed %t (error: %v)", renewed, err)
+	}
+}
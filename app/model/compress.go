@@ -0,0 +1,89 @@
+package model
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var RESULT_COMPRESSION string = ""
+var RESULT_COMPRESSION_THRESHOLD int = 1024
+
+// The formats a stored async result can be in.  Compressed results start with the format version
+// and the compression, e.g. "1:gzip:".  Uncompressed results are plain JSON, as they always were.
+const (
+	resultFormatVersion = "1"
+	CompressionGzip     = "gzip"
+	CompressionZstd     = "zstd"
+)
+
+var zstdEncoder *zstd.Encoder
+var zstdDecoder *zstd.Decoder
+var zstdOnce sync.Once
+
+// The zstd encoder and decoder are safe to share, and expensive to create
+func getZstd() (*zstd.Encoder, *zstd.Decoder) {
+	zstdOnce.Do(func() {
+		zstdEncoder, _ = zstd.NewWriter(nil)
+		zstdDecoder, _ = zstd.NewReader(nil)
+	})
+	return zstdEncoder, zstdDecoder
+}
+
+// Compresses a result with RESULT_COMPRESSION, if it's larger than RESULT_COMPRESSION_THRESHOLD bytes
+func compressResult(data []byte) (string, error) {
+	if RESULT_COMPRESSION == "" || len(data) <= RESULT_COMPRESSION_THRESHOLD {
+		return string(data), nil
+	}
+
+	var compressed []byte
+	switch RESULT_COMPRESSION {
+	case CompressionGzip:
+		var buffer bytes.Buffer
+		writer := gzip.NewWriter(&buffer)
+		if _, err := writer.Write(data); err != nil {
+			return "", err
+		} else if err := writer.Close(); err != nil {
+			return "", err
+		}
+		compressed = buffer.Bytes()
+	case CompressionZstd:
+		encoder, _ := getZstd()
+		compressed = encoder.EncodeAll(data, nil)
+	default:
+		return "", fmt.Errorf("Unknown result compression: %s", RESULT_COMPRESSION)
+	}
+
+	return resultFormatVersion + ":" + RESULT_COMPRESSION + ":" + string(compressed), nil
+}
+
+// Decompresses a result written by compressResult.  Uncompressed results are returned as they are.
+func decompressResult(data string) ([]byte, error) {
+	if strings.HasPrefix(data, "{") {
+		return []byte(data), nil
+	}
+
+	parts := strings.SplitN(data, ":", 3)
+	if len(parts) != 3 || parts[0] != resultFormatVersion {
+		return nil, fmt.Errorf("Unknown result format: %.10q", data)
+	}
+
+	switch parts[1] {
+	case CompressionGzip:
+		reader, err := gzip.NewReader(strings.NewReader(parts[2]))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return ioutil.ReadAll(reader)
+	case CompressionZstd:
+		_, decoder := getZstd()
+		return decoder.DecodeAll([]byte(parts[2]), nil)
+	}
+	return nil, fmt.Errorf("Unknown result compression: %s", parts[1])
+}
@@ -0,0 +1,58 @@
+package model
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompressResult(t *testing.T) {
+	defer func(compression string, threshold int) {
+		RESULT_COMPRESSION, RESULT_COMPRESSION_THRESHOLD = compression, threshold
+	}(RESULT_COMPRESSION, RESULT_COMPRESSION_THRESHOLD)
+
+	large := `{"code":200,"body":"` + strings.Repeat("x", 2000) + `"}`
+	tests := []struct {
+		name        string
+		compression string
+		threshold   int
+		data        string
+		prefix      string
+	}{
+		{"off", "", 10, large, "{"},
+		{"under the threshold", CompressionGzip, 1024, `{"code":200}`, "{"},
+		{"gzip", CompressionGzip, 1024, large, "1:gzip:"},
+		{"zstd", CompressionZstd, 1024, large, "1:zstd:"},
+	}
+
+	for _, test := range tests {
+		RESULT_COMPRESSION, RESULT_COMPRESSION_THRESHOLD = test.compression, test.threshold
+		compressed, err := compressResult([]byte(test.data))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		} else if !strings.HasPrefix(compressed, test.prefix) {
+			t.Errorf("%s: expected the result to start with %q, got %.10q", test.name, test.prefix, compressed)
+		}
+
+		// Results are read back whatever RESULT_COMPRESSION is now, so it can be changed safely
+		RESULT_COMPRESSION = ""
+		if data, err := decompressResult(compressed); err != nil || string(data) != test.data {
+			t.Errorf("%s: round trip gave %.20q (error: %v)", test.name, data, err)
+		}
+	}
+}
+
+func TestDecompressInvalidResult(t *testing.T) {
+	tests := []string{
+		"2:gzip:data",
+		"1:brotli:data",
+		"1:gzip:not gzip",
+		"garbage",
+	}
+
+	for _, data := range tests {
+		if _, err := decompressResult(data); err == nil {
+			t.Errorf("Expected %q to be invalid", data)
+		}
+	}
+}
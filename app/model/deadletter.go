@@ -0,0 +1,241 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/pborman/uuid"
+	"gopkg.in/redis.v2"
+)
+
+var ASYNC_ITEM_ATTEMPTS int = 3
+var ASYNC_ITEM_BACKOFF int = 500
+
+// The hash of dead lettered messages, keyed by dead letter ID
+const deadLettersKey = "batch:deadletters"
+
+// The sorted set of dead letter IDs, scored by when they were dead lettered
+const deadLettersIndexKey = "batch:deadletters:index"
+
+// An error processing an async batch item message.  Retry is false if trying again can't fix it,
+// and Requested is true if the item's request was already made, so it mustn't be processed again.
+type AsyncItemError struct {
+	Reason    string
+	Retry     bool
+	Requested bool
+	Err       error
+}
+
+func (itemErr AsyncItemError) Error() string {
+	return fmt.Sprintf("%s: %s", itemErr.Reason, itemErr.Err)
+}
+
+// A kafka message for an async batch item that couldn't be processed
+type DeadLetter struct {
+	ID        string    `json:"id"`
+	Reason    string    `json:"reason"`
+	Error     string    `json:"error"`
+	Attempts  int       `json:"attempts"`
+	Topic     string    `json:"topic"`
+	Partition int32     `json:"partition"`
+	Offset    int64     `json:"offset"`
+	Key       string    `json:"key"`
+	Value     string    `json:"value"`
+	Created   time.Time `json:"created"`
+}
+
+// Saves a message that failed processing so it can be inspected and replayed later
+func DeadLetterMessage(redis *redis.Client, message *sarama.ConsumerMessage, attempts int, err error) error {
+	return saveDeadLetter(redis, message, newDeadLetter(message, attempts, err))
+}
+
+// Get the dead letter for a message that failed processing
+func newDeadLetter(message *sarama.ConsumerMessage, attempts int, err error) DeadLetter {
+	deadLetter := DeadLetter{
+		ID:        uuid.New(),
+		Reason:    "unknown",
+		Error:     err.Error(),
+		Attempts:  attempts,
+		Topic:     message.Topic,
+		Partition: message.Partition,
+		Offset:    message.Offset,
+		Key:       string(message.Key),
+		Value:     string(message.Value),
+		Created:   time.Now(),
+	}
+	if itemErr, ok := err.(AsyncItemError); ok {
+		deadLetter.Reason = itemErr.Reason
+		deadLetter.Error = itemErr.Err.Error()
+	}
+	return deadLetter
+}
+
+func saveDeadLetter(redis *redis.Client, message *sarama.ConsumerMessage, deadLetter DeadLetter) error {
+	output, _ := json.Marshal(deadLetter)
+	saveCmd := redis.HSet(deadLettersKey, deadLetter.ID, string(output))
+	if _, err := saveCmd.Result(); err != nil {
+		countRedisError("dead_letter")
+		log.Printf("An error occurred saving dead letter to Redis: [dead letter id: %s] [key: %s] [offset: %d] [partition: %d] [topic: %s] (error: %s)", deadLetter.ID, message.Key, message.Offset, message.Partition, message.Topic, err)
+		return err
+	}
+
+	indexCmd := redis.ZAdd(deadLettersIndexKey, redisZ(float64(deadLetter.Created.UnixNano()), deadLetter.ID))
+	if _, err := indexCmd.Result(); err != nil {
+		countRedisError("dead_letter")
+		log.Printf("An error occurred indexing dead letter in Redis: [dead letter id: %s] (error: %s)", deadLetter.ID, err)
+		return err
+	}
+
+	log.Printf("Message dead lettered: [dead letter id: %s] [reason: %s] [attempts: %d] [key: %s] [offset: %d] [partition: %d] [topic: %s]", deadLetter.ID, deadLetter.Reason, deadLetter.Attempts, message.Key, message.Offset, message.Partition, message.Topic)
+	return nil
+}
+
+// Dead letters a message, trying again with a backoff while it can't be saved, so the message
+// isn't lost when redis is down.  Returns false if ctx was done before it was saved, in which
+// case the message mustn't be committed.
+func deadLetterWithRetries(ctx context.Context, redis *redis.Client, message *sarama.ConsumerMessage, attempts int, err error) bool {
+	deadLetter := newDeadLetter(message, attempts, err)
+	backoff := time.Duration(ASYNC_ITEM_BACKOFF) * time.Millisecond
+	maxBackoff := time.Duration(WORKER_RESTART_MAX_BACKOFF) * time.Millisecond
+	for {
+		if saveDeadLetter(redis, message, deadLetter) == nil {
+			return true
+		}
+
+		log.Printf("Dead letter not saved. Retrying in %s: [dead letter id: %s] [key: %s] [offset: %d] [partition: %d] [topic: %s]", backoff, deadLetter.ID, message.Key, message.Offset, message.Partition, message.Topic)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// Lists dead letters, oldest first
+func ListDeadLetters(offset, limit int64) ([]DeadLetter, int64, error) {
+	redis := GetAsyncJobRedis()
+	defer redis.Close()
+
+	totalCmd := redis.ZCard(deadLettersIndexKey)
+	total, err := totalCmd.Result()
+	if err != nil {
+		log.Printf("An error occurred counting dead letters in Redis: %s", err)
+		return nil, 0, fmt.Errorf("An internal server error occurred.")
+	}
+
+	idsCmd := redis.ZRange(deadLettersIndexKey, offset, offset+limit-1)
+	ids, err := idsCmd.Result()
+	if err != nil {
+		log.Printf("An error occurred listing dead letters in Redis: %s", err)
+		return nil, 0, fmt.Errorf("An internal server error occurred.")
+	}
+
+	deadLetters := []DeadLetter{}
+	for _, id := range ids {
+		deadLetter, err := getDeadLetter(redis, id)
+		if err != nil {
+			continue
+		}
+		deadLetters = append(deadLetters, deadLetter)
+	}
+
+	return deadLetters, total, nil
+}
+
+// Gets a single dead letter
+func GetDeadLetter(id string) (DeadLetter, error) {
+	redis := GetAsyncJobRedis()
+	defer redis.Close()
+
+	return getDeadLetter(redis, id)
+}
+
+func getDeadLetter(redis *redis.Client, id string) (DeadLetter, error) {
+	getCmd := redis.HGet(deadLettersKey, id)
+	data, err := getCmd.Result()
+	if IsRedisNil(err) {
+		return DeadLetter{}, fmt.Errorf("The dead letter can not be found.")
+	} else if err != nil {
+		log.Printf("An error occurred getting dead letter from Redis: [dead letter id: %s] (error: %s)", id, err)
+		return DeadLetter{}, fmt.Errorf("An internal server error occurred.")
+	}
+
+	var deadLetter DeadLetter
+	if err := json.Unmarshal([]byte(data), &deadLetter); err != nil {
+		log.Printf("This shouldn't happen. We put this JSON into Redis and it should always be properly formatted. [dead letter id: %s] (error: %s)", id, err)
+		return DeadLetter{}, fmt.Errorf("An internal server error occurred.")
+	}
+
+	return deadLetter, nil
+}
+
+// Sends a dead lettered message back to its original topic for the workers to process again
+func ReplayDeadLetter(id string) error {
+	redis := GetAsyncJobRedis()
+	defer redis.Close()
+
+	deadLetter, err := getDeadLetter(redis, id)
+	if err != nil {
+		return err
+	}
+
+	producer, err := GetAsyncBatchProducer()
+	if err != nil {
+		return fmt.Errorf("An internal server error occurred.")
+	}
+
+	message := &sarama.ProducerMessage{
+		Topic: deadLetter.Topic,
+		Key:   sarama.ByteEncoder(deadLetter.Key),
+		Value: sarama.ByteEncoder(deadLetter.Value),
+	}
+
+	partition, offset, err := producer.SendMessage(message)
+	if err != nil {
+		log.Printf("An error occurred replaying dead letter to Kafka: [dead letter id: %s] (error: %s)", id, err)
+		return fmt.Errorf("An internal server error occurred.")
+	}
+
+	redis.HDel(deadLettersKey, id)
+	redis.ZRem(deadLettersIndexKey, id)
+
+	log.Printf("Dead letter replayed: [dead letter id: %s] [partition: %d] (offset: %d)", id, partition, offset)
+	return nil
+}
+
+// Processes a message, retrying it with a backoff while it fails with a retryable error.  If it
+// still can't be processed it is dead lettered, as is a message whose request was made but whose
+// result couldn't be saved.  Returns false if ctx was done before the message was finished or
+// dead lettered, in which case it should be processed again.
+func processMessageWithRetries(ctx context.Context, workerNum int, message *sarama.ConsumerMessage, redis *redis.Client) bool {
+	backoff := time.Duration(ASYNC_ITEM_BACKOFF) * time.Millisecond
+	for attempts := 1; ; attempts++ {
+		err := processMessage(ctx, message, redis)
+		itemErr, ok := err.(AsyncItemError)
+		if err == nil {
+			return true
+		} else if ctx.Err() != nil && !itemErr.Requested {
+			return false
+		}
+		recordAsyncWorkerError(workerNum, message, err)
+
+		if !ok || !itemErr.Retry || attempts >= ASYNC_ITEM_ATTEMPTS {
+			return deadLetterWithRetries(ctx, redis, message, attempts, err)
+		}
+
+		log.Printf("An error occurred processing message. Retrying in %s: [key: %s] [offset: %d] [partition: %d] [topic: %s] [attempt: %d] (error: %s)", backoff, message.Key, message.Offset, message.Partition, message.Topic, attempts, err)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
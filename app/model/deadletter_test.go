@@ -0,0 +1,50 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"gopkg.in/redis.v2"
+)
+
+func TestNewDeadLetter(t *testing.T) {
+	message := &sarama.ConsumerMessage{Topic: TOPIC, Partition: 2, Offset: 7, Key: []byte("key"), Value: []byte("value")}
+	tests := []struct {
+		name   string
+		err    error
+		reason string
+		error  string
+	}{
+		{"item error", AsyncItemError{Reason: "unmarshal", Err: fmt.Errorf("bad json")}, "unmarshal", "bad json"},
+		{"other error", fmt.Errorf("boom"), "unknown", "boom"},
+	}
+
+	for _, test := range tests {
+		deadLetter := newDeadLetter(message, 3, test.err)
+		if deadLetter.Reason != test.reason || deadLetter.Error != test.error {
+			t.Errorf("%s: got reason %q and error %q, expected %q and %q", test.name, deadLetter.Reason, deadLetter.Error, test.reason, test.error)
+		} else if deadLetter.Attempts != 3 || deadLetter.Offset != 7 || deadLetter.Partition != 2 || deadLetter.Value != "value" {
+			t.Errorf("%s: expected the dead letter to keep the message, got %+v", test.name, deadLetter)
+		}
+	}
+}
+
+func TestProcessMessageWithRetriesKeepsMessageWhenDeadLetterFails(t *testing.T) {
+	defer func(backoff int) { ASYNC_ITEM_BACKOFF = backoff }(ASYNC_ITEM_BACKOFF)
+	ASYNC_ITEM_BACKOFF = 10
+
+	// Nothing listens on this port, so saving the dead letter always fails
+	down := redis.NewTCPClient(&redis.Options{Addr: "127.0.0.1:1"})
+	defer down.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	message := &sarama.ConsumerMessage{Topic: TOPIC, Offset: 1, Value: []byte("not json")}
+	if processed := processMessageWithRetries(ctx, 0, message, down); processed {
+		t.Errorf("Expected a message that couldn't be dead lettered not to be committed")
+	}
+}
@@ -0,0 +1,86 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+var ASYNC_MESSAGE_VERSION int = 1
+var BUILD_VERSION string = "dev"
+
+// The newest schema version of the async batch item messages this code can read.  Version 0 is
+// the original message, a bare AsyncBatchItem.
+const AsyncMessageSchemaVersion = 1
+
+// Wraps an async batch item written to kafka with what's needed to read it across versions
+type AsyncMessageEnvelope struct {
+	SchemaVersion   int               `json:"schemaVersion"`
+	ProducerVersion string            `json:"producerVersion"`
+	Created         time.Time         `json:"created"`
+	TraceContext    map[string]string `json:"traceContext,omitempty"`
+	Item            AsyncBatchItem    `json:"item"`
+}
+
+// Converts an async batch item to a kafka message in the ASYNC_MESSAGE_VERSION schema.  Producers
+// keep writing version 0 while any workers that can only read version 0 are still running.
+func encodeAsyncMessage(item AsyncBatchItem, traceContext map[string]string) []byte {
+	if ASYNC_MESSAGE_VERSION == 0 {
+		output, _ := json.Marshal(item)
+		return output
+	}
+
+	output, _ := json.Marshal(AsyncMessageEnvelope{
+		SchemaVersion:   AsyncMessageSchemaVersion,
+		ProducerVersion: BUILD_VERSION,
+		Created:         time.Now(),
+		TraceContext:    traceContext,
+		Item:            item,
+	})
+	return output
+}
+
+// Reads a kafka message in any known schema version, upgrading older versions to the current
+// envelope.  Returns an AsyncItemError if the message is malformed, invalid, or of a newer version
+// than this code knows.  Those are dead lettered rather than dropped, so they can be replayed once
+// the workers are upgraded.
+func decodeAsyncMessage(value []byte) (AsyncMessageEnvelope, error) {
+	var header struct {
+		SchemaVersion *int `json:"schemaVersion"`
+	}
+	if err := json.Unmarshal(value, &header); err != nil {
+		return AsyncMessageEnvelope{}, AsyncItemError{Reason: "unmarshal", Retry: false, Err: err}
+	}
+
+	var envelope AsyncMessageEnvelope
+	switch {
+	case header.SchemaVersion == nil:
+		if err := json.Unmarshal(value, &envelope.Item); err != nil {
+			return AsyncMessageEnvelope{}, AsyncItemError{Reason: "unmarshal", Retry: false, Err: err}
+		}
+	case *header.SchemaVersion == AsyncMessageSchemaVersion:
+		if err := json.Unmarshal(value, &envelope); err != nil {
+			return AsyncMessageEnvelope{}, AsyncItemError{Reason: "unmarshal", Retry: false, Err: err}
+		}
+	default:
+		err := fmt.Errorf("Schema version %d is not supported. The newest supported is %d", *header.SchemaVersion, AsyncMessageSchemaVersion)
+		return AsyncMessageEnvelope{}, AsyncItemError{Reason: "unknown_version", Retry: false, Err: err}
+	}
+
+	if err := envelope.Item.validate(); err != nil {
+		return AsyncMessageEnvelope{}, AsyncItemError{Reason: "invalid", Retry: false, Err: err}
+	}
+	return envelope, nil
+}
+
+// Checks the async batch item has everything a worker needs to process it
+func (item AsyncBatchItem) validate() error {
+	if item.RequestID == "" {
+		return fmt.Errorf("Missing requestId")
+	} else if item.Index < 0 {
+		return fmt.Errorf("Invalid idx: %d", item.Index)
+	} else if item.Item.Method == "" || item.Item.URL == "" {
+		return fmt.Errorf("Missing item method or url")
+	}
+	return nil
+}
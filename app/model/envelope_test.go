@@ -0,0 +1,63 @@
+package model
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestAsyncMessageEnvelope(t *testing.T) {
+	defer func(version int) {
+		ASYNC_MESSAGE_VERSION = version
+	}(ASYNC_MESSAGE_VERSION)
+
+	item := AsyncBatchItem{
+		RequestID:  "request",
+		Index:      3,
+		IdentityID: "identity",
+		Item:       BatchItem{Method: "GET", URL: "https://example.com/"},
+	}
+	traceContext := map[string]string{"traceparent": "00-trace-span-01"}
+
+	tests := []struct {
+		name    string
+		version int
+		traced  bool
+	}{
+		{"bare item", 0, false},
+		{"envelope", 1, true},
+	}
+
+	for _, test := range tests {
+		ASYNC_MESSAGE_VERSION = test.version
+		envelope, err := decodeAsyncMessage(encodeAsyncMessage(item, traceContext))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		} else if fmt.Sprint(envelope.Item) != fmt.Sprint(item) {
+			t.Errorf("%s: got item %v, expected %v", test.name, envelope.Item, item)
+		} else if traced := envelope.TraceContext["traceparent"] != ""; traced != test.traced {
+			t.Errorf("%s: kept trace context %t, expected %t", test.name, traced, test.traced)
+		}
+	}
+}
+
+func TestDecodeInvalidAsyncMessage(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  string
+		reason string
+	}{
+		{"not json", `not json`, "unmarshal"},
+		{"newer version", `{"schemaVersion":2,"item":{}}`, "unknown_version"},
+		{"bad envelope", `{"schemaVersion":1,"item":"item"}`, "unmarshal"},
+		{"missing request id", `{"schemaVersion":1,"item":{"idx":0,"item":{"method":"GET","url":"/"}}}`, "invalid"},
+		{"negative index", `{"requestId":"request","idx":-1,"item":{"method":"GET","url":"/"}}`, "invalid"},
+		{"missing url", `{"requestId":"request","idx":0,"item":{"method":"GET"}}`, "invalid"},
+	}
+
+	for _, test := range tests {
+		_, err := decodeAsyncMessage([]byte(test.value))
+		if itemErr, ok := err.(AsyncItemError); !ok || itemErr.Reason != test.reason || itemErr.Retry {
+			t.Errorf("%s: expected a %s error that isn't retried, got %v", test.name, test.reason, err)
+		}
+	}
+}
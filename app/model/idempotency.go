@@ -0,0 +1,153 @@
+package model
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+var IDEMPOTENCY_EXPIRE int = 1440
+var IDEMPOTENCY_PENDING_EXPIRE int = 300
+
+// Returned when an idempotency key is reused with a different request, or while the first request is still running
+var ErrIdempotencyConflict = fmt.Errorf("This Idempotency-Key was already used for a different request, or that request is still being processed")
+
+// Saves the idempotency key's request hash, only if the key hasn't been used yet
+const claimIdempotencyScript = `
+if redis.call("SET", KEYS[1], ARGV[1], "NX", "EX", ARGV[2]) then
+	return ""
+end
+return redis.call("GET", KEYS[1])
+`
+
+// Keeps holding the idempotency key for another ARGV[2] seconds, only while its request is still pending
+const renewIdempotencyScript = `
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+redis.call("EXPIRE", KEYS[1], ARGV[2])
+return 1
+`
+
+// The first response for a request sent with an idempotency key
+type IdempotentResponse struct {
+	RequestHash string            `json:"requestHash"`
+	Complete    bool              `json:"complete"`
+	Status      int               `json:"status"`
+	Headers     map[string]string `json:"headers"`
+	Body        string            `json:"body"`
+}
+
+// Get the redis key holding the response for an identity's idempotency key
+func idempotencyKey(identityID, key string) string {
+	return "batch:idempotency:" + identityID + ":" + key
+}
+
+// Hashes the parts of a request that have to match for it to count as a duplicate
+func HashIdempotentRequest(method, path string, body []byte) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s %s\n", method, path)
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// What's saved for an idempotency key while its first request is processed
+func pendingIdempotentResponse(requestHash string) string {
+	pending, _ := json.Marshal(IdempotentResponse{RequestHash: requestHash})
+	return string(pending)
+}
+
+// Starts a request sent with an idempotency key.  Returns nil if this is the first time the key
+// was sent, and the request should be processed.  Returns the first response if the key was
+// already used for the same request, and ErrIdempotencyConflict if it was used for a different one.
+// The key is held for IDEMPOTENCY_PENDING_EXPIRE seconds at a time while the request is processed,
+// see KeepIdempotentRequest, so a request that never finishes, like when the server crashes,
+// doesn't hold it for long.
+func StartIdempotentRequest(identityID, key, requestHash string) (*IdempotentResponse, error) {
+	redis := GetAsyncJobRedis()
+	defer redis.Close()
+
+	claimCmd := redis.Eval(claimIdempotencyScript, []string{idempotencyKey(identityID, key)}, []string{pendingIdempotentResponse(requestHash), strconv.Itoa(IDEMPOTENCY_PENDING_EXPIRE)})
+	claimResult, err := claimCmd.Result()
+	if err != nil {
+		countRedisError("idempotency")
+		log.Printf("An error occurred claiming idempotency key in Redis: [identity id: %s] [key: %s] (error: %s)", identityID, key, err)
+		return nil, fmt.Errorf("An internal server error occurred.")
+	}
+
+	existing, _ := claimResult.(string)
+	if existing == "" {
+		return nil, nil
+	}
+
+	var response IdempotentResponse
+	if err := json.Unmarshal([]byte(existing), &response); err != nil {
+		log.Printf("This shouldn't happen. We put this JSON into Redis and it should always be properly formatted. [identity id: %s] [key: %s] (error: %s)", identityID, key, err)
+		return nil, fmt.Errorf("An internal server error occurred.")
+	}
+
+	if response.RequestHash != requestHash || !response.Complete {
+		return nil, ErrIdempotencyConflict
+	}
+
+	log.Printf("Replaying response for idempotency key: [identity id: %s] [key: %s]", identityID, key)
+	return &response, nil
+}
+
+// Keeps holding an idempotency key for its pending request until done is closed, renewing it
+// every third of IDEMPOTENCY_PENDING_EXPIRE.  Stops early if the key was released.
+func KeepIdempotentRequest(identityID, key, requestHash string, done <-chan bool) {
+	redis := GetAsyncJobRedis()
+	defer redis.Close()
+
+	ticker := time.NewTicker(time.Duration(IDEMPOTENCY_PENDING_EXPIRE) * time.Second / 3)
+	defer ticker.Stop()
+
+	pending := pendingIdempotentResponse(requestHash)
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		renewCmd := redis.Eval(renewIdempotencyScript, []string{idempotencyKey(identityID, key)}, []string{pending, strconv.Itoa(IDEMPOTENCY_PENDING_EXPIRE)})
+		renewResult, err := renewCmd.Result()
+		if err != nil {
+			countRedisError("idempotency")
+			log.Printf("An error occurred renewing idempotency key in Redis: [identity id: %s] [key: %s] (error: %s)", identityID, key, err)
+		} else if renewed, _ := renewResult.(int64); renewed != 1 {
+			return
+		}
+	}
+}
+
+// Saves the first response for a request sent with an idempotency key, so it can be returned for
+// duplicates for IDEMPOTENCY_EXPIRE minutes
+func FinishIdempotentRequest(identityID, key string, response IdempotentResponse) error {
+	redis := GetAsyncJobRedis()
+	defer redis.Close()
+
+	response.Complete = true
+	output, _ := json.Marshal(response)
+
+	saveCmd := redis.SetEx(idempotencyKey(identityID, key), time.Duration(IDEMPOTENCY_EXPIRE)*time.Minute, string(output))
+	if _, err := saveCmd.Result(); err != nil {
+		countRedisError("idempotency")
+		log.Printf("An error occurred saving idempotent response to Redis: [identity id: %s] [key: %s] (error: %s)", identityID, key, err)
+		return err
+	}
+	return nil
+}
+
+// Releases an idempotency key whose request failed, so the client can retry it
+func AbortIdempotentRequest(identityID, key string) {
+	redis := GetAsyncJobRedis()
+	defer redis.Close()
+
+	redis.Del(idempotencyKey(identityID, key))
+}
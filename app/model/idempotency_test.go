@@ -0,0 +1,93 @@
+package model
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pborman/uuid"
+)
+
+func TestHashIdempotentRequest(t *testing.T) {
+	hash := HashIdempotentRequest("POST", "/batch", []byte(`[]`))
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		same   bool
+	}{
+		{"same request", "POST", "/batch", `[]`, true},
+		{"different path", "POST", "/batch/async", `[]`, false},
+		{"different body", "POST", "/batch", `[{}]`, false},
+	}
+
+	for _, test := range tests {
+		if same := HashIdempotentRequest(test.method, test.path, []byte(test.body)) == hash; same != test.same {
+			t.Errorf("%s: same hash %t, expected %t", test.name, same, test.same)
+		}
+	}
+}
+
+func TestIdempotentRequest(t *testing.T) {
+	redis := testRedis(t)
+	defer redis.Close()
+
+	key := uuid.New()
+	t.Cleanup(func() {
+		redis.Del(idempotencyKey("identity", key))
+	})
+
+	if response, err := StartIdempotentRequest("identity", key, "hash"); err != nil || response != nil {
+		t.Fatalf("Expected the first request to be processed, got %v (error: %v)", response, err)
+	}
+	if _, err := StartIdempotentRequest("identity", key, "hash"); err != ErrIdempotencyConflict {
+		t.Errorf("Expected a conflict while the first request is processed, got %v", err)
+	}
+
+	err := FinishIdempotentRequest("identity", key, IdempotentResponse{RequestHash: "hash", Status: 202, Body: "done"})
+	if err != nil {
+		t.Fatalf("Unable to save the response: %s", err)
+	}
+	if response, err := StartIdempotentRequest("identity", key, "hash"); err != nil || response == nil || response.Body != "done" {
+		t.Errorf("Expected the saved response to be replayed, got %v (error: %v)", response, err)
+	}
+	if _, err := StartIdempotentRequest("identity", key, "other"); err != ErrIdempotencyConflict {
+		t.Errorf("Expected a conflict for a different request, got %v", err)
+	}
+
+	// A key released after a failure can be used again
+	AbortIdempotentRequest("identity", key)
+	if response, err := StartIdempotentRequest("identity", key, "other"); err != nil || response != nil {
+		t.Errorf("Expected the released key to be processed again, got %v (error: %v)", response, err)
+	}
+}
+
+func TestKeepIdempotentRequest(t *testing.T) {
+	redis := testRedis(t)
+	defer redis.Close()
+
+	defer func(expire int) {
+		IDEMPOTENCY_PENDING_EXPIRE = expire
+	}(IDEMPOTENCY_PENDING_EXPIRE)
+	IDEMPOTENCY_PENDING_EXPIRE = 3
+
+	key := uuid.New()
+	t.Cleanup(func() {
+		redis.Del(idempotencyKey("identity", key))
+	})
+
+	if _, err := StartIdempotentRequest("identity", key, "hash"); err != nil {
+		t.Fatalf("Unable to start the request: %s", err)
+	}
+
+	// The key outlives its pending expiration while the request is processed
+	done := make(chan bool)
+	go KeepIdempotentRequest("identity", key, "hash", done)
+	time.Sleep(4 * time.Second)
+	close(done)
+
+	if _, err := StartIdempotentRequest("identity", key, "hash"); err != ErrIdempotencyConflict {
+		t.Errorf("Expected the key to still be held, got %v", err)
+	}
+}
@@ -0,0 +1,347 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"gopkg.in/redis.v2"
+)
+
+// The statuses of an async batch job
+const (
+	AsyncJobScheduled = "scheduled"
+	AsyncJobPending   = "pending"
+	AsyncJobComplete  = "complete"
+	AsyncJobCancelled = "cancelled"
+	AsyncJobFailed    = "failed"
+)
+
+// The statuses of the callback for an async batch job
+const (
+	CallbackPending   = "pending"
+	CallbackDelivered = "delivered"
+	CallbackFailed    = "failed"
+)
+
+// The metadata stored in redis for an async batch job
+type AsyncJob struct {
+	RequestID        string            `json:"requestId"`
+	IdentityID       string            `json:"identityId"`
+	Status           string            `json:"status"`
+	Total            int64             `json:"total"`
+	Completed        int64             `json:"completed"`
+	Takeovers        int64             `json:"takeovers,omitempty"`
+	Created          time.Time         `json:"created"`
+	CompletedAt      *time.Time        `json:"completedAt,omitempty"`
+	ResultTTL        int64             `json:"resultTtl"`
+	RunAt            time.Time         `json:"runAt,omitempty"`
+	Priority         string            `json:"priority"`
+	Ordering         string            `json:"ordering"`
+	CallbackURL      string            `json:"callbackUrl,omitempty"`
+	CallbackHeaders  map[string]string `json:"-"`
+	CallbackSecret   string            `json:"-"`
+	CallbackStatus   string            `json:"callbackStatus,omitempty"`
+	CallbackAttempts int64             `json:"callbackAttempts,omitempty"`
+	CallbackCode     int64             `json:"callbackCode,omitempty"`
+	CallbackError    string            `json:"callbackError,omitempty"`
+	Error            string            `json:"error,omitempty"`
+	TraceContext     map[string]string `json:"-"`
+}
+
+// Get the redis key holding the metadata for an async batch job
+func AsyncJobKey(requestID string) string {
+	return requestID + ":job"
+}
+
+// Get the redis key holding the batch items of an async batch job, so they can be sent to the workers again
+func AsyncJobItemsKey(requestID string) string {
+	return requestID + ":items"
+}
+
+// Get all of the redis keys that make up an async batch job
+func AsyncJobKeys(requestID string) []string {
+	return []string{
+		requestID,
+		AsyncJobKey(requestID),
+		AsyncJobItemsKey(requestID),
+		AsyncJobClaimsKey(requestID),
+		AsyncJobTakeoversKey(requestID),
+		AsyncJobAttemptsKey(requestID),
+	}
+}
+
+// Convert the job to the field/value pairs stored in the redis hash
+func (job AsyncJob) fields() []string {
+	callbackHeaders, _ := json.Marshal(job.CallbackHeaders)
+	traceContext, _ := json.Marshal(job.TraceContext)
+	var runAt string
+	if !job.RunAt.IsZero() {
+		runAt = job.RunAt.Format(time.RFC3339Nano)
+	}
+	return []string{
+		"identityId", job.IdentityID,
+		"status", job.Status,
+		"total", strconv.FormatInt(job.Total, 10),
+		"completed", strconv.FormatInt(job.Completed, 10),
+		"created", job.Created.Format(time.RFC3339Nano),
+		"runAt", runAt,
+		"priority", job.Priority,
+		"ordering", job.Ordering,
+		"resultTtl", strconv.FormatInt(job.ResultTTL, 10),
+		"callbackUrl", job.CallbackURL,
+		"callbackHeaders", string(callbackHeaders),
+		"callbackSecret", job.CallbackSecret,
+		"callbackStatus", job.CallbackStatus,
+		"traceContext", string(traceContext),
+	}
+}
+
+// Saves the batch items of an async batch job, for when it's scheduled or its items have to be sent again
+func saveAsyncJobItems(redis *redis.Client, requestID string, batchItems BatchItems) error {
+	items := make([]string, len(batchItems))
+	for idx, batchItem := range batchItems {
+		output, _ := json.Marshal(batchItem)
+		items[idx] = string(output)
+	}
+
+	pushCmd := redis.RPush(AsyncJobItemsKey(requestID), items...)
+	if _, err := pushCmd.Result(); err != nil {
+		countRedisError("save_items")
+		log.Printf("An error occurred saving batch items to Redis: [request id: %s] (error: %s)", requestID, err)
+		return err
+	}
+	return nil
+}
+
+// Gets the saved batch items of an async batch job
+func getAsyncJobItems(redis *redis.Client, requestID string) (BatchItems, error) {
+	itemsCmd := redis.LRange(AsyncJobItemsKey(requestID), 0, -1)
+	items, err := itemsCmd.Result()
+	if err != nil {
+		countRedisError("get_items")
+		log.Printf("An error occurred getting batch items from Redis: [request id: %s] (error: %s)", requestID, err)
+		return nil, err
+	}
+
+	batchItems := make(BatchItems, len(items))
+	for idx, item := range items {
+		if err := json.Unmarshal([]byte(item), &batchItems[idx]); err != nil {
+			log.Printf("This shouldn't happen. We put this JSON into Redis and it should always be properly formatted. [request id: %s] [index: %d] (error: %s)", requestID, idx, err)
+			return nil, err
+		}
+	}
+
+	return batchItems, nil
+}
+
+// Saves the metadata for an async batch job
+func SaveAsyncJob(redis *redis.Client, job AsyncJob) error {
+	fields := job.fields()
+	saveCmd := redis.HMSet(AsyncJobKey(job.RequestID), fields[0], fields[1], fields[2:]...)
+	if _, err := saveCmd.Result(); err != nil {
+		countRedisError("save_job")
+		log.Printf("An error occurred saving async job to Redis: [request id: %s] (error: %s)", job.RequestID, err)
+		return err
+	}
+	return nil
+}
+
+// Sets some of the fields for an async batch job
+func UpdateAsyncJob(redis *redis.Client, requestID string, field, value string, pairs ...string) error {
+	updateCmd := redis.HMSet(AsyncJobKey(requestID), field, value, pairs...)
+	if _, err := updateCmd.Result(); err != nil {
+		countRedisError("update_job")
+		log.Printf("An error occurred updating async job in Redis: [request id: %s] [field: %s] (error: %s)", requestID, field, err)
+		return err
+	}
+	return nil
+}
+
+// Gets the metadata for an async batch job
+func GetAsyncJob(redis *redis.Client, requestID string) (AsyncJob, error) {
+	getCmd := redis.HGetAllMap(AsyncJobKey(requestID))
+	fields, err := getCmd.Result()
+	if err != nil {
+		countRedisError("get_job")
+		log.Printf("An error occurred getting async job from Redis: [request id: %s] (error: %s)", requestID, err)
+		return AsyncJob{}, fmt.Errorf("An internal server error occurred.")
+	} else if len(fields) == 0 {
+		return AsyncJob{}, fmt.Errorf("The async batch request can not be found.  It may have expired.")
+	}
+
+	job := AsyncJob{
+		RequestID:      requestID,
+		IdentityID:     fields["identityId"],
+		Status:         fields["status"],
+		Priority:       fields["priority"],
+		Ordering:       fields["ordering"],
+		CallbackURL:    fields["callbackUrl"],
+		CallbackSecret: fields["callbackSecret"],
+		CallbackStatus: fields["callbackStatus"],
+		CallbackError:  fields["callbackError"],
+		Error:          fields["error"],
+	}
+	job.Total, _ = strconv.ParseInt(fields["total"], 10, 64)
+	job.Completed, _ = strconv.ParseInt(fields["completed"], 10, 64)
+	job.Takeovers, _ = strconv.ParseInt(fields["takeovers"], 10, 64)
+	job.CallbackAttempts, _ = strconv.ParseInt(fields["callbackAttempts"], 10, 64)
+	job.CallbackCode, _ = strconv.ParseInt(fields["callbackCode"], 10, 64)
+	job.ResultTTL, _ = strconv.ParseInt(fields["resultTtl"], 10, 64)
+	if completedAt, err := time.Parse(time.RFC3339Nano, fields["completedAt"]); err == nil {
+		job.CompletedAt = &completedAt
+	}
+	job.Created, _ = time.Parse(time.RFC3339Nano, fields["created"])
+	job.RunAt, _ = time.Parse(time.RFC3339Nano, fields["runAt"])
+	_ = json.Unmarshal([]byte(fields["callbackHeaders"]), &job.CallbackHeaders)
+	_ = json.Unmarshal([]byte(fields["traceContext"]), &job.TraceContext)
+
+	return job, nil
+}
+
+// Gets only the status of an async batch job
+func GetAsyncJobStatus(redis *redis.Client, requestID string) (string, error) {
+	statusCmd := redis.HGet(AsyncJobKey(requestID), "status")
+	status, err := statusCmd.Result()
+	if err != nil && !IsRedisNil(err) {
+		countRedisError("get_job")
+		log.Printf("An error occurred getting async job status from Redis: [request id: %s] (error: %s)", requestID, err)
+		return "", err
+	}
+	return status, nil
+}
+
+// Get an async batch job of an identity.  The jobs of other identities can't be found, the same
+// as jobs that don't exist.
+func GetIdentityAsyncJob(redis *redis.Client, identityID, requestID string) (AsyncJob, error) {
+	job, err := GetAsyncJob(redis, requestID)
+	if err != nil {
+		return AsyncJob{}, err
+	} else if job.IdentityID != identityID {
+		return AsyncJob{}, fmt.Errorf("The async batch request can not be found.  It may have expired.")
+	}
+	return job, nil
+}
+
+// Cancels an async batch job of an identity.  Items of the job that haven't been processed yet
+// are skipped by the workers, and the job expires after ASYNC_CANCEL_EXPIRE minutes.
+func CancelAsyncJob(identityID, requestID string) error {
+	redis := GetAsyncJobRedis()
+	defer redis.Close()
+
+	job, err := GetIdentityAsyncJob(redis, identityID, requestID)
+	if err != nil {
+		return err
+	}
+	return cancelAsyncJob(redis, job)
+}
+
+// Cancels an async batch job unless it already finished, so it can't complete in between.  The
+// job is marked cancelled at ARGV[1], taken off the schedule in KEYS[1], and its keys, from KEYS[2]
+// on, expire in ARGV[2] seconds.  Returns the status the job had, or "" if it has expired.
+const cancelJobScript = `
+local status = redis.call("HGET", KEYS[3], "status")
+if not status then
+	return ""
+elseif status == "complete" or status == "cancelled" or status == "failed" then
+	return status
+end
+redis.call("HSET", KEYS[3], "status", "cancelled")
+redis.call("HSET", KEYS[3], "cancelled", ARGV[1])
+redis.call("ZREM", KEYS[1], KEYS[2])
+for i = 2, #KEYS do
+	redis.call("EXPIRE", KEYS[i], ARGV[2])
+end
+return status
+`
+
+// Cancels an async batch job, whichever identity it belongs to
+func cancelAsyncJob(redis *redis.Client, job AsyncJob) error {
+	requestID := job.RequestID
+	keys := append([]string{asyncScheduleKey}, AsyncJobKeys(requestID)...)
+	cancelCmd := redis.Eval(cancelJobScript, keys, []string{
+		time.Now().Format(time.RFC3339Nano),
+		strconv.Itoa(ASYNC_CANCEL_EXPIRE * 60),
+	})
+	cancelResult, err := cancelCmd.Result()
+	if err != nil {
+		countRedisError("cancel_job")
+		log.Printf("An error occurred cancelling async job in Redis: [request id: %s] (error: %s)", requestID, err)
+		return fmt.Errorf("An internal server error occurred.")
+	}
+
+	switch status, _ := cancelResult.(string); status {
+	case "":
+		return fmt.Errorf("The async batch request can not be found.  It may have expired.")
+	case AsyncJobComplete:
+		return fmt.Errorf("The async batch request has already completed.")
+	case AsyncJobCancelled, AsyncJobFailed:
+		return nil
+	}
+
+	log.Printf("Async job cancelled: [request id: %s] [completed: %d] [total: %d]", requestID, job.Completed, job.Total)
+	return nil
+}
+
+// Marks an async batch job as failed when only some of its items could be sent to the workers.
+// The items that were sent are skipped, and the job expires after ASYNC_CANCEL_EXPIRE minutes.
+func FailAsyncJob(redis *redis.Client, requestID, reason string) error {
+	err := UpdateAsyncJob(redis, requestID,
+		"status", AsyncJobFailed,
+		"error", reason)
+	if err != nil {
+		return err
+	}
+
+	if err := ExpireAsyncJob(redis, requestID, time.Duration(ASYNC_CANCEL_EXPIRE)*time.Minute); err != nil {
+		return err
+	}
+
+	log.Printf("Async job failed: [request id: %s] (error: %s)", requestID, reason)
+	return nil
+}
+
+// Get how long the results of the job are kept after it completes
+func (job AsyncJob) ResultTTLDuration() time.Duration {
+	if job.ResultTTL > 0 {
+		return time.Duration(job.ResultTTL) * time.Second
+	}
+	return time.Duration(ASYNC_EXPIRE) * time.Minute
+}
+
+// Restarts the result TTL of a completed async batch job of an identity, so its results are kept
+// for another result TTL from now.  Jobs that haven't completed are kept while they're making
+// progress anyway.
+func ExtendAsyncJob(identityID, requestID string) error {
+	redis := GetAsyncJobRedis()
+	defer redis.Close()
+
+	job, err := GetIdentityAsyncJob(redis, identityID, requestID)
+	if err != nil {
+		return err
+	} else if job.Status != AsyncJobComplete {
+		return nil
+	}
+
+	if err := ExpireAsyncJob(redis, requestID, job.ResultTTLDuration()); err != nil {
+		return fmt.Errorf("An internal server error occurred.")
+	}
+
+	log.Printf("Async job result TTL extended: [request id: %s] [ttl: %s]", requestID, job.ResultTTLDuration())
+	return nil
+}
+
+// Sets the expiration on all of the keys for an async batch job
+func ExpireAsyncJob(redis *redis.Client, requestID string, expiration time.Duration) error {
+	for _, key := range AsyncJobKeys(requestID) {
+		expireCmd := redis.Expire(key, expiration)
+		if _, err := expireCmd.Result(); err != nil {
+			countRedisError("expire_job")
+			log.Printf("An error occurred setting expiration on async job: [request id: %s] [key: %s] (error: %s)", requestID, key, err)
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package model
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResultTTLDuration(t *testing.T) {
+	defer func(expire int) {
+		ASYNC_EXPIRE = expire
+	}(ASYNC_EXPIRE)
+	ASYNC_EXPIRE = 60
+
+	tests := []struct {
+		name      string
+		resultTTL int64
+		expected  time.Duration
+	}{
+		{"default", 0, time.Hour},
+		{"set by the client", 300, 5 * time.Minute},
+	}
+
+	for _, test := range tests {
+		if ttl := (AsyncJob{ResultTTL: test.resultTTL}).ResultTTLDuration(); ttl != test.expected {
+			t.Errorf("%s: got %s, expected %s", test.name, ttl, test.expected)
+		}
+	}
+}
+
+func TestExtendAsyncJob(t *testing.T) {
+	redis := testRedis(t)
+	defer redis.Close()
+
+	requestID := testAsyncJob(t, redis, AsyncJobComplete, `{"code":200}`)
+	redis.HSet(AsyncJobKey(requestID), "resultTtl", "300")
+	redis.Expire(requestID, time.Minute)
+
+	// Another identity can't extend the request, or tell it exists
+	if err := ExtendAsyncJob("other", requestID); err == nil || !strings.Contains(err.Error(), "can not be found") {
+		t.Errorf("Expected the request not to be found for another identity, got %v", err)
+	} else if ttl, _ := redis.TTL(requestID).Result(); ttl > time.Minute {
+		t.Errorf("Expected the request not to be extended, got a TTL of %s", ttl)
+	}
+
+	if err := ExtendAsyncJob("identity", requestID); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	} else if ttl, _ := redis.TTL(requestID).Result(); ttl <= time.Minute || ttl > 5*time.Minute {
+		t.Errorf("Expected the request to be kept for its result TTL, got a TTL of %s", ttl)
+	}
+}
+
+func TestCancelAsyncJob(t *testing.T) {
+	redis := testRedis(t)
+	defer redis.Close()
+
+	tests := []struct {
+		name      string
+		status    string
+		cancelled bool
+		err       bool
+	}{
+		{"pending", AsyncJobPending, true, false},
+		{"scheduled", AsyncJobScheduled, true, false},
+		{"complete", AsyncJobComplete, false, true},
+		{"failed", AsyncJobFailed, false, false},
+	}
+
+	for _, test := range tests {
+		requestID := testAsyncJob(t, redis, test.status, "")
+		redis.ZAdd(asyncScheduleKey, redisZ(float64(time.Now().Unix()), requestID))
+		defer redis.ZRem(asyncScheduleKey, requestID)
+
+		if err := CancelAsyncJob("identity", requestID); (err != nil) != test.err {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+
+		status, _ := redis.HGet(AsyncJobKey(requestID), "status").Result()
+		if cancelled := status == AsyncJobCancelled; cancelled != test.cancelled {
+			t.Errorf("%s: got status %s", test.name, status)
+		}
+		if _, err := redis.ZScore(asyncScheduleKey, requestID).Result(); test.cancelled && !IsRedisNil(err) {
+			t.Errorf("%s: expected the cancelled job to be taken off the schedule", test.name)
+		}
+	}
+
+	if err := CancelAsyncJob("other", testAsyncJob(t, redis, AsyncJobPending, "")); err == nil {
+		t.Errorf("Expected another identity not to be able to cancel the job")
+	}
+}
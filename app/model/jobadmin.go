@@ -0,0 +1,213 @@
+package model
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"gopkg.in/redis.v2"
+)
+
+// Filters for listing async batch jobs.  Empty fields match every job.
+type AsyncJobFilter struct {
+	IdentityID string
+	Status     string
+	OlderThan  time.Duration
+	NewerThan  time.Duration
+}
+
+// Checks whether a job matches the filter, with its age measured from now
+func (filter AsyncJobFilter) Match(job AsyncJob, now time.Time) bool {
+	age := now.Sub(job.Created)
+	switch {
+	case filter.IdentityID != "" && job.IdentityID != filter.IdentityID:
+		return false
+	case filter.Status != "" && job.Status != filter.Status:
+		return false
+	case filter.OlderThan > 0 && age < filter.OlderThan:
+		return false
+	case filter.NewerThan > 0 && age > filter.NewerThan:
+		return false
+	}
+	return true
+}
+
+// An async batch job, along with how many of its items don't have a result yet
+type AsyncJobDetail struct {
+	AsyncJob
+	Pending int64 `json:"pending"`
+}
+
+// Lists the async batch jobs that match the filter, newest first.  This scans every key in
+// redis, so it's meant for debugging rather than for serving requests.
+func ListAsyncJobs(filter AsyncJobFilter) ([]AsyncJob, error) {
+	redis := GetAsyncJobRedis()
+	defer redis.Close()
+
+	now := time.Now()
+	jobs := []AsyncJob{}
+	for cursor := int64(0); ; {
+		scanCmd := redis.Scan(cursor, "*:job", 1000)
+		next, keys, err := scanCmd.Result()
+		if err != nil {
+			log.Printf("An error occurred scanning async jobs in Redis: %s", err)
+			return nil, fmt.Errorf("An internal server error occurred.")
+		}
+
+		for _, key := range keys {
+			job, err := GetAsyncJob(redis, strings.TrimSuffix(key, ":job"))
+			if err != nil || !filter.Match(job, now) {
+				continue
+			}
+			jobs = append(jobs, job)
+		}
+
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].Created.After(jobs[j].Created)
+	})
+	return jobs, nil
+}
+
+// Gets an async batch job, along with how many of its items don't have a result yet
+func GetAsyncJobDetail(requestID string) (AsyncJobDetail, error) {
+	redis := GetAsyncJobRedis()
+	defer redis.Close()
+
+	job, err := GetAsyncJob(redis, requestID)
+	if err != nil {
+		return AsyncJobDetail{}, err
+	}
+
+	pending, err := pendingAsyncItems(redis, requestID)
+	if err != nil {
+		return AsyncJobDetail{}, fmt.Errorf("An internal server error occurred.")
+	}
+
+	return AsyncJobDetail{AsyncJob: job, Pending: int64(len(pending))}, nil
+}
+
+// Get the indexes of the items of an async batch job that don't have a result yet
+func pendingAsyncItems(redis *redis.Client, requestID string) ([]int64, error) {
+	pending := []int64{}
+	for start := int64(0); ; start += ASYNC_PAGE_MAX_LIMIT {
+		resultsCmd := redis.LRange(requestID, start, start+ASYNC_PAGE_MAX_LIMIT-1)
+		results, err := resultsCmd.Result()
+		if err != nil {
+			log.Printf("An error occurred getting async results from Redis: [request id: %s] (error: %s)", requestID, err)
+			return nil, err
+		}
+
+		for idx, result := range results {
+			if result == "" {
+				pending = append(pending, start+int64(idx))
+			}
+		}
+
+		if int64(len(results)) < ASYNC_PAGE_MAX_LIMIT {
+			return pending, nil
+		}
+	}
+}
+
+// Cancels an async batch job of any identity
+func CancelAnyAsyncJob(requestID string) error {
+	redis := GetAsyncJobRedis()
+	defer redis.Close()
+
+	job, err := GetAsyncJob(redis, requestID)
+	if err != nil {
+		return err
+	}
+	return cancelAsyncJob(redis, job)
+}
+
+// Sends the items of an async batch job that don't have a result yet to the workers again, for
+// jobs that are stuck or failed to be sent.  Items that are still being processed only run once,
+// since the workers claim each item before running it.  Returns the number of items sent.
+func RetryAsyncJob(requestID string) (int, error) {
+	redis := GetAsyncJobRedis()
+	defer redis.Close()
+
+	job, err := GetAsyncJob(redis, requestID)
+	if err != nil {
+		return 0, err
+	}
+
+	switch job.Status {
+	case AsyncJobScheduled:
+		return 0, fmt.Errorf("The async batch request hasn't been sent to the workers yet.")
+	case AsyncJobCancelled:
+		return 0, fmt.Errorf("The async batch request was cancelled.")
+	case AsyncJobComplete:
+		return 0, nil
+	}
+
+	pending, err := pendingAsyncItems(redis, requestID)
+	if err != nil {
+		return 0, fmt.Errorf("An internal server error occurred.")
+	} else if len(pending) == 0 {
+		return 0, nil
+	}
+
+	batchItems, err := getAsyncJobItems(redis, requestID)
+	if err != nil {
+		return 0, fmt.Errorf("An internal server error occurred.")
+	} else if int64(len(batchItems)) != job.Total {
+		return 0, fmt.Errorf("The batch items of the async batch request weren't saved, so it can't be retried.")
+	}
+
+	if job.Status == AsyncJobFailed {
+		if err := UpdateAsyncJob(redis, requestID, "status", AsyncJobPending, "error", ""); err != nil {
+			return 0, fmt.Errorf("An internal server error occurred.")
+		}
+		ExpireAsyncJob(redis, requestID, time.Duration(ASYNC_EXPIRE)*time.Minute)
+	}
+
+	messages := make([]*sarama.ProducerMessage, len(pending))
+	for idx, index := range pending {
+		messages[idx] = asyncItemMessage(job, index, batchItems[index])
+	}
+
+	if err := sendAsyncItems(job, messages); err != nil {
+		FailAsyncJob(redis, requestID, "Not all of the batch items could be sent to the workers.")
+		return 0, err
+	}
+
+	log.Printf("Async job retried: [request id: %s] [items: %d]", requestID, len(messages))
+	return len(messages), nil
+}
+
+// Deletes an async batch job and all of its results right away, whatever its status.  Workers
+// skip any of its items they haven't processed yet.
+func PurgeAsyncJob(requestID string) error {
+	redis := GetAsyncJobRedis()
+	defer redis.Close()
+
+	if _, err := GetAsyncJob(redis, requestID); err != nil {
+		return err
+	}
+
+	unscheduleAsyncJob(redis, requestID)
+	unscheduleAsyncCallback(redis, requestID)
+	delCmd := redis.Del(AsyncJobKeys(requestID)...)
+	if _, err := delCmd.Result(); err != nil {
+		log.Printf("An error occurred purging async job from Redis: [request id: %s] (error: %s)", requestID, err)
+		return fmt.Errorf("An internal server error occurred.")
+	}
+
+	if store, err := GetBlobStore(); err == nil {
+		store.Delete(requestID)
+	}
+
+	log.Printf("Async job purged: [request id: %s]", requestID)
+	return nil
+}
@@ -0,0 +1,40 @@
+package model
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAsyncJobFilterMatch(t *testing.T) {
+	now := time.Now()
+	job := AsyncJob{
+		IdentityID: "identity",
+		Status:     AsyncJobPending,
+		Created:    now.Add(-2 * time.Hour),
+	}
+
+	tests := []struct {
+		name     string
+		filter   AsyncJobFilter
+		expected bool
+	}{
+		{"empty filter", AsyncJobFilter{}, true},
+		{"same identity", AsyncJobFilter{IdentityID: "identity"}, true},
+		{"other identity", AsyncJobFilter{IdentityID: "other"}, false},
+		{"same status", AsyncJobFilter{Status: AsyncJobPending}, true},
+		{"other status", AsyncJobFilter{Status: AsyncJobComplete}, false},
+		{"older than less", AsyncJobFilter{OlderThan: time.Hour}, true},
+		{"older than more", AsyncJobFilter{OlderThan: 3 * time.Hour}, false},
+		{"newer than more", AsyncJobFilter{NewerThan: 3 * time.Hour}, true},
+		{"newer than less", AsyncJobFilter{NewerThan: time.Hour}, false},
+		{"within a window", AsyncJobFilter{OlderThan: time.Hour, NewerThan: 3 * time.Hour}, true},
+		{"everything matches", AsyncJobFilter{IdentityID: "identity", Status: AsyncJobPending, OlderThan: time.Hour}, true},
+		{"one field doesn't match", AsyncJobFilter{IdentityID: "identity", Status: AsyncJobFailed, OlderThan: time.Hour}, false},
+	}
+
+	for _, test := range tests {
+		if matched := test.filter.Match(job, now); matched != test.expected {
+			t.Errorf("%s: matched %t, expected %t", test.name, matched, test.expected)
+		}
+	}
+}
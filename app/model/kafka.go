@@ -6,41 +6,267 @@ import (
 	"github.com/wvanbergen/kazoo-go"
 	"log"
 	"strings"
+	"sync"
 	"time"
 )
 
+var PRODUCER_BATCH_SIZE int = 1000
+var PRODUCER_FLUSH_MESSAGES int = 500
+var PRODUCER_FLUSH_FREQUENCY int = 10
+var PRODUCER_RESEND_ATTEMPTS int = 3
+
+// The producer shared by every async batch request, created the first time it's needed
+var sharedProducer sarama.SyncProducer
+var sharedProducerLock sync.Mutex
+
 // NewAsyncBatchProducer gets a new producer instance for producing batch item messages to kafka
 // Can be overridden for mocking kafka
 var NewAsyncBatchProducer = func(zookeeperConn string) (sarama.SyncProducer, error) {
 	zookeeper, err := kazoo.NewKazooFromConnectionString(zookeeperConn, kazoo.NewConfig())
 	if err != nil {
-		log.Fatalln("An error occurred connecting to zookeeper", err)
+		log.Println("An error occurred connecting to zookeeper", err)
 		return nil, err
 	}
+	defer zookeeper.Close()
 
 	config := sarama.NewConfig()
 	config.Producer.RequiredAcks = sarama.WaitForAll
 	config.Producer.Retry.Max = 3
 	config.Producer.Retry.Backoff = 100 * time.Millisecond
-	// TODO: This is a reminder to try profiling against batching these vs sending them 1-by-1
-	//config.Producer.Flush.Messages = 10000
-	//config.Producer.Flush.MaxMessages = 10000
+	// Messages sent together with SendMessages are grouped into produce requests of up to
+	// PRODUCER_FLUSH_MESSAGES, instead of a round trip to the broker for every message
+	config.Producer.Flush.Messages = PRODUCER_FLUSH_MESSAGES
+	config.Producer.Flush.Frequency = time.Duration(PRODUCER_FLUSH_FREQUENCY) * time.Millisecond
+	config.Producer.Return.Successes = true
 
 	brokerList, err := zookeeper.BrokerList()
 	if err != nil {
-		log.Fatalln("An error occurred getting broker list from zookeeper", err)
+		log.Println("An error occurred getting broker list from zookeeper", err)
 		return nil, err
 	}
 
 	producer, err := sarama.NewSyncProducer(brokerList, config)
 	if err != nil {
-		log.Fatalln("Failed to start Sarama producer:", err)
+		log.Println("Failed to start Sarama producer:", err)
 		return nil, err
 	}
 
 	return producer, nil
 }
 
+// Get the long-lived producer shared by every async batch request.  It's only closed on shutdown,
+// so callers must not close it.
+func sharedAsyncBatchProducer() (sarama.SyncProducer, error) {
+	sharedProducerLock.Lock()
+	defer sharedProducerLock.Unlock()
+
+	if sharedProducer != nil {
+		return sharedProducer, nil
+	}
+
+	producer, err := NewAsyncBatchProducer(ZOOKEEPER)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Println("Async batch producer started")
+	sharedProducer = producer
+	return sharedProducer, nil
+}
+
+// Closes the shared producer, flushing any messages it's still sending
+func CloseAsyncBatchProducer() {
+	sharedProducerLock.Lock()
+	defer sharedProducerLock.Unlock()
+
+	if sharedProducer == nil {
+		return
+	}
+
+	if err := sharedProducer.Close(); err != nil {
+		log.Println("An error occurred closing the async batch producer: ", err)
+	}
+	sharedProducer = nil
+}
+
+// Sends the messages to kafka in batches of PRODUCER_BATCH_SIZE.  Messages that kafka doesn't
+// accept are sent again, up to PRODUCER_RESEND_ATTEMPTS times.  Returns the messages that still
+// couldn't be sent, along with the last error.
+func sendMessages(producer sarama.SyncProducer, messages []*sarama.ProducerMessage) ([]*sarama.ProducerMessage, error) {
+	var lastErr error
+	for attempts := 0; len(messages) > 0 && attempts <= PRODUCER_RESEND_ATTEMPTS; attempts++ {
+		if attempts > 0 {
+			log.Printf("Resending messages kafka didn't accept: [messages: %d] [attempt: %d] (error: %s)", len(messages), attempts, lastErr)
+			time.Sleep(time.Duration(attempts) * 100 * time.Millisecond)
+		}
+
+		batchSize := PRODUCER_BATCH_SIZE
+		if batchSize <= 0 {
+			batchSize = len(messages)
+		}
+
+		var failed []*sarama.ProducerMessage
+		for start := 0; start < len(messages); start += batchSize {
+			end := start + batchSize
+			if end > len(messages) {
+				end = len(messages)
+			}
+
+			err := producer.SendMessages(messages[start:end])
+			if producerErrs, ok := err.(sarama.ProducerErrors); ok {
+				for _, producerErr := range producerErrs {
+					failed = append(failed, producerErr.Msg)
+				}
+				lastErr = err
+			} else if err != nil {
+				failed = append(failed, messages[start:end]...)
+				lastErr = err
+			}
+		}
+		messages = failed
+	}
+
+	if len(messages) > 0 {
+		return messages, lastErr
+	}
+	return nil, nil
+}
+
+// The messages of an ordering key that are still to be sent
+type orderedMessages struct {
+	messages []*sarama.ProducerMessage
+	attempts int
+}
+
+// Sends messages that have to reach kafka in order, in batches of PRODUCER_BATCH_SIZE.  Messages
+// with the same key are sent in the order given, and only the ones kafka didn't accept from the
+// front of a key are sent again, so a resent message never lands behind a later one of its key.
+// A key is given up on once it fails PRODUCER_RESEND_ATTEMPTS times, or kafka accepted a later
+// message of the key than one it didn't.  Returns the messages of the keys given up on that
+// weren't accepted, along with the last error.
+func sendOrderedMessages(producer sarama.SyncProducer, messages []*sarama.ProducerMessage) ([]*sarama.ProducerMessage, error) {
+	var keys []string
+	pending := map[string]*orderedMessages{}
+	for _, message := range messages {
+		key := ""
+		if message.Key != nil {
+			encoded, _ := message.Key.Encode()
+			key = string(encoded)
+		}
+		if _, ok := pending[key]; !ok {
+			keys = append(keys, key)
+			pending[key] = &orderedMessages{}
+		}
+		pending[key].messages = append(pending[key].messages, message)
+	}
+
+	batchSize := PRODUCER_BATCH_SIZE
+	if batchSize <= 0 {
+		batchSize = len(messages)
+	}
+
+	var failed []*sarama.ProducerMessage
+	var lastErr error
+	for round := 0; len(keys) > 0; round++ {
+		// Each key sends a run from its front, as much as fits in the batch.  Keys that don't fit
+		// wait for the next round.
+		var batch []*sarama.ProducerMessage
+		runs := map[string][]*sarama.ProducerMessage{}
+		for _, key := range keys {
+			room := batchSize - len(batch)
+			if room <= 0 {
+				break
+			}
+			run := pending[key].messages
+			if len(run) > room {
+				run = run[:room]
+			}
+			runs[key] = run
+			batch = append(batch, run...)
+		}
+
+		rejected := map[*sarama.ProducerMessage]bool{}
+		err := producer.SendMessages(batch)
+		if producerErrs, ok := err.(sarama.ProducerErrors); ok {
+			for _, producerErr := range producerErrs {
+				rejected[producerErr.Msg] = true
+			}
+			lastErr = err
+		} else if err != nil {
+			for _, message := range batch {
+				rejected[message] = true
+			}
+			lastErr = err
+		}
+
+		var remaining []string
+		resend := false
+		for _, key := range keys {
+			run, ok := runs[key]
+			if !ok {
+				remaining = append(remaining, key)
+				continue
+			}
+
+			ordered := pending[key]
+			first := len(run)
+			for idx, message := range run {
+				if rejected[message] {
+					first = idx
+					break
+				}
+			}
+
+			outOfOrder := false
+			for _, message := range run[first:] {
+				if !rejected[message] {
+					outOfOrder = true
+				}
+			}
+
+			ordered.messages = ordered.messages[first:]
+			if first < len(run) {
+				ordered.attempts++
+				resend = true
+			}
+
+			if outOfOrder || ordered.attempts > PRODUCER_RESEND_ATTEMPTS {
+				for _, message := range ordered.messages {
+					if rejected[message] || !containsMessage(run, message) {
+						failed = append(failed, message)
+					}
+				}
+				log.Printf("Giving up sending messages kafka didn't accept in order: [key: %s] [messages: %d] [attempt: %d] (error: %s)", key, len(ordered.messages), ordered.attempts, lastErr)
+				continue
+			}
+
+			if len(ordered.messages) > 0 {
+				remaining = append(remaining, key)
+			}
+		}
+		keys = remaining
+
+		if resend && len(keys) > 0 {
+			log.Printf("Resending messages kafka didn't accept: [keys: %d] [round: %d] (error: %s)", len(keys), round+1, lastErr)
+			time.Sleep(time.Duration(round+1) * 100 * time.Millisecond)
+		}
+	}
+
+	if len(failed) > 0 {
+		return failed, lastErr
+	}
+	return nil, nil
+}
+
+func containsMessage(messages []*sarama.ProducerMessage, message *sarama.ProducerMessage) bool {
+	for _, other := range messages {
+		if other == message {
+			return true
+		}
+	}
+	return false
+}
+
 // creates the task consumer for the kafka queues
 func NewAsyncBatchConsumer(zookeeperConn, consumerGroup, topic string, headOffset int64, resetOffsets bool) (*consumergroup.ConsumerGroup, error) {
 
@@ -66,3 +292,106 @@ func NewAsyncBatchConsumer(zookeeperConn, consumerGroup, topic string, headOffse
 
 	return consumer, nil
 }
+
+// The lag of a partition of an async batch topic, which is how many of its messages the consumer
+// group hasn't committed yet
+type PartitionLag struct {
+	Topic     string
+	Partition int32
+	Lag       int64
+}
+
+// Reads the lag of the async batch consumer groups
+type ConsumerLagReader interface {
+	Lag() ([]PartitionLag, error)
+	Close() error
+}
+
+// NewConsumerLagReader gets a reader for the lag of the consumer groups of every priority
+// Can be overridden for mocking kafka
+var NewConsumerLagReader = func(zookeeperConn string) (ConsumerLagReader, error) {
+	zookeeper, err := kazoo.NewKazooFromConnectionString(zookeeperConn, kazoo.NewConfig())
+	if err != nil {
+		log.Println("An error occurred connecting to zookeeper", err)
+		return nil, err
+	}
+
+	brokerList, err := zookeeper.BrokerList()
+	if err != nil {
+		log.Println("An error occurred getting broker list from zookeeper", err)
+		zookeeper.Close()
+		return nil, err
+	}
+
+	client, err := sarama.NewClient(brokerList, sarama.NewConfig())
+	if err != nil {
+		log.Println("Failed to start Sarama client:", err)
+		zookeeper.Close()
+		return nil, err
+	}
+
+	return &kafkaLagReader{zookeeper: zookeeper, client: client}, nil
+}
+
+// Get the offset to ask the brokers for where a consumer group starts reading a partition it
+// hasn't committed to yet.  That's the newest offset if headOffset is sarama.OffsetNewest, and the
+// oldest otherwise, since the brokers only answer for those two.
+func headOffsetQuery(headOffset int64) int64 {
+	if headOffset == sarama.OffsetNewest {
+		return sarama.OffsetNewest
+	}
+	return sarama.OffsetOldest
+}
+
+// Reads the committed offsets of the consumer groups from zookeeper, and the high-water marks of
+// the partitions from the brokers
+type kafkaLagReader struct {
+	zookeeper *kazoo.Kazoo
+	client    sarama.Client
+}
+
+// Get the lag of every partition of the async batch topics, which is its high-water mark minus
+// the offset committed for it.  Partitions the group hasn't committed to yet count from
+// HEAD_OFFSETS, where the group starts reading them.
+func (reader *kafkaLagReader) Lag() ([]PartitionLag, error) {
+	lags := []PartitionLag{}
+	for _, priority := range AsyncPriorities {
+		offsets, err := reader.zookeeper.Consumergroup(PriorityConsumerGroup(priority)).FetchAllOffsets()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, topic := range strings.Split(PriorityTopic(priority), ",") {
+			partitions, err := reader.client.Partitions(topic)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, partition := range partitions {
+				highWaterMark, err := reader.client.GetOffset(topic, partition, sarama.OffsetNewest)
+				if err != nil {
+					return nil, err
+				}
+
+				committed, ok := offsets[topic][partition]
+				if !ok || committed < 0 {
+					if committed, err = reader.client.GetOffset(topic, partition, headOffsetQuery(HEAD_OFFSETS)); err != nil {
+						return nil, err
+					}
+				}
+
+				lag := highWaterMark - committed
+				if lag < 0 {
+					lag = 0
+				}
+				lags = append(lags, PartitionLag{Topic: topic, Partition: partition, Lag: lag})
+			}
+		}
+	}
+	return lags, nil
+}
+
+func (reader *kafkaLagReader) Close() error {
+	reader.client.Close()
+	return reader.zookeeper.Close()
+}
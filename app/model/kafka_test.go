@@ -0,0 +1,122 @@
+package model
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/Shopify/sarama"
+)
+
+// A producer that rejects the messages named in each call, in order, and records what it accepted
+type testProducer struct {
+	sarama.SyncProducer
+	rejects  []map[string]bool
+	calls    int
+	accepted []string
+}
+
+func (producer *testProducer) SendMessages(messages []*sarama.ProducerMessage) error {
+	var reject map[string]bool
+	if producer.calls < len(producer.rejects) {
+		reject = producer.rejects[producer.calls]
+	}
+	producer.calls++
+
+	var errs sarama.ProducerErrors
+	for _, message := range messages {
+		value, _ := message.Value.Encode()
+		if reject[string(value)] {
+			errs = append(errs, &sarama.ProducerError{Msg: message, Err: fmt.Errorf("rejected")})
+		} else {
+			producer.accepted = append(producer.accepted, string(value))
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func testProducerMessages(keys ...string) []*sarama.ProducerMessage {
+	messages := make([]*sarama.ProducerMessage, len(keys))
+	counts := map[string]int{}
+	for idx, key := range keys {
+		messages[idx] = &sarama.ProducerMessage{
+			Topic: TOPIC,
+			Key:   sarama.StringEncoder(key),
+			Value: sarama.StringEncoder(fmt.Sprintf("%s%d", key, counts[key])),
+		}
+		counts[key]++
+	}
+	return messages
+}
+
+func TestSendOrderedMessages(t *testing.T) {
+	defer func(attempts, batchSize int) {
+		PRODUCER_RESEND_ATTEMPTS, PRODUCER_BATCH_SIZE = attempts, batchSize
+	}(PRODUCER_RESEND_ATTEMPTS, PRODUCER_BATCH_SIZE)
+	PRODUCER_RESEND_ATTEMPTS = 2
+
+	tests := []struct {
+		name      string
+		batchSize int
+		keys      []string
+		rejects   []map[string]bool
+		accepted  []string
+		failed    []string
+	}{
+		{
+			name:     "all accepted",
+			keys:     []string{"a", "b", "a"},
+			accepted: []string{"a0", "a1", "b0"},
+		},
+		{
+			name:     "rejected from the front of a key",
+			keys:     []string{"a", "a", "a", "b"},
+			rejects:  []map[string]bool{{"a1": true, "a2": true}},
+			accepted: []string{"a0", "b0", "a1", "a2"},
+		},
+		{
+			name:     "accepted behind a rejected message",
+			keys:     []string{"a", "a", "a", "b"},
+			rejects:  []map[string]bool{{"a1": true}},
+			accepted: []string{"a0", "a2", "b0"},
+			failed:   []string{"a1"},
+		},
+		{
+			name:     "rejected every time",
+			keys:     []string{"a", "a", "b"},
+			rejects:  []map[string]bool{{"a0": true, "a1": true}, {"a0": true, "a1": true}, {"a0": true, "a1": true}},
+			accepted: []string{"b0"},
+			failed:   []string{"a0", "a1"},
+		},
+		{
+			name:      "split into batches",
+			batchSize: 2,
+			keys:      []string{"a", "a", "a", "b"},
+			rejects:   []map[string]bool{{"a1": true}},
+			accepted:  []string{"a0", "a1", "a2", "b0"},
+		},
+	}
+
+	for _, test := range tests {
+		PRODUCER_BATCH_SIZE = test.batchSize
+		producer := &testProducer{rejects: test.rejects}
+		failed, err := sendOrderedMessages(producer, testProducerMessages(test.keys...))
+
+		if fmt.Sprint(producer.accepted) != fmt.Sprint(test.accepted) {
+			t.Errorf("%s: accepted %v, expected %v", test.name, producer.accepted, test.accepted)
+		}
+
+		failedValues := []string{}
+		for _, message := range failed {
+			value, _ := message.Value.Encode()
+			failedValues = append(failedValues, string(value))
+		}
+		if fmt.Sprint(failedValues) != fmt.Sprint(test.failed) {
+			t.Errorf("%s: failed %v, expected %v", test.name, failedValues, test.failed)
+		} else if (err != nil) != (len(test.failed) > 0) {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+	}
+}
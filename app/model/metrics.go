@@ -0,0 +1,157 @@
+package model
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The prometheus metrics for the webserver, the batches it runs, and the async workers
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "batch",
+		Name:      "http_requests_total",
+		Help:      "HTTP requests handled, by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "batch",
+		Name:      "http_request_duration_seconds",
+		Help:      "How long HTTP requests took to handle, by route and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	batchSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "batch",
+		Name:      "size_items",
+		Help:      "The number of items in each batch, by whether it was ran sync or async.",
+		Buckets:   []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000},
+	}, []string{"mode"})
+
+	itemRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "batch",
+		Name:      "item_request_duration_seconds",
+		Help:      "How long downstream requests for batch items took, by service.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"service"})
+
+	itemRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "batch",
+		Name:      "item_requests_total",
+		Help:      "Downstream requests for batch items, by service and status code. The code is \"error\" when the request itself failed.",
+	}, []string{"service", "code"})
+
+	asyncItemsEnqueued = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "batch",
+		Name:      "async_items_enqueued_total",
+		Help:      "Async batch items sent to kafka, by priority and result.",
+	}, []string{"priority", "result"})
+
+	workerItemDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "batch",
+		Name:      "worker_item_duration_seconds",
+		Help:      "How long the async workers took to process an item, by kafka topic.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"topic"})
+
+	consumerLagItems = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "batch",
+		Name:      "worker_consumer_lag_items",
+		Help:      "Async batch items in each partition the consumer group hasn't committed, which is the high-water mark less the committed offset.",
+	}, []string{"topic", "partition"})
+
+	workerCount = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "batch",
+		Name:      "workers",
+		Help:      "The number of async workers running.",
+	})
+
+	workerInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "batch",
+		Name:      "worker_items_in_flight",
+		Help:      "The number of async batch items being processed.",
+	})
+
+	redisErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "batch",
+		Name:      "redis_errors_total",
+		Help:      "Redis operations that failed, by operation.",
+	}, []string{"operation"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		httpRequests,
+		httpRequestDuration,
+		batchSize,
+		itemRequestDuration,
+		itemRequests,
+		asyncItemsEnqueued,
+		workerItemDuration,
+		consumerLagItems,
+		workerCount,
+		workerInFlight,
+		redisErrors,
+	)
+}
+
+// Records an HTTP request handled by the webserver
+func ObserveHTTPRequest(route, method string, code int, duration time.Duration) {
+	httpRequests.WithLabelValues(route, method, strconv.Itoa(code)).Inc()
+	httpRequestDuration.WithLabelValues(route, method).Observe(duration.Seconds())
+}
+
+// Records the number of items in a batch, for mode sync or async
+func ObserveBatchSize(mode string, items int) {
+	batchSize.WithLabelValues(mode).Observe(float64(items))
+}
+
+// Get the service a batch item is sent to, for labelling its metrics.  All external requests
+// share one label, so the label can't grow without bound.
+func (batchItem BatchItem) Service() string {
+	if strings.HasPrefix(batchItem.URL, "http") {
+		return "external"
+	}
+	return strings.SplitN(batchItem.URL, "://", 2)[0]
+}
+
+// Records a downstream request for a batch item.  err is the error making the request, if any.
+func observeItemRequest(batchItem BatchItem, code int, err error, duration time.Duration) {
+	service := batchItem.Service()
+	itemRequestDuration.WithLabelValues(service).Observe(duration.Seconds())
+	if err != nil {
+		itemRequests.WithLabelValues(service, "error").Inc()
+	} else {
+		itemRequests.WithLabelValues(service, strconv.Itoa(code)).Inc()
+	}
+}
+
+// Records async batch items sent to kafka, with result sent or failed
+func observeAsyncEnqueue(priority, result string, items int) {
+	asyncItemsEnqueued.WithLabelValues(priority, result).Add(float64(items))
+}
+
+// Records an async batch item processed by a worker
+func observeWorkerItem(topic string, duration time.Duration) {
+	workerItemDuration.WithLabelValues(topic).Observe(duration.Seconds())
+}
+
+// Records the state of the async workers
+func observeWorkers(workers, inFlight int) {
+	workerCount.Set(float64(workers))
+	workerInFlight.Set(float64(inFlight))
+}
+
+// Records the lag of each partition of the async batch topics
+func observeConsumerLag(partitions []PartitionLag) {
+	for _, partition := range partitions {
+		consumerLagItems.WithLabelValues(partition.Topic, strconv.Itoa(int(partition.Partition))).Set(float64(partition.Lag))
+	}
+}
+
+// Counts a redis operation that failed
+func countRedisError(operation string) {
+	redisErrors.WithLabelValues(operation).Inc()
+}
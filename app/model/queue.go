@@ -0,0 +1,314 @@
+package model
+
+import (
+	"fmt"
+
+	"github.com/Shopify/sarama"
+)
+
+// The priorities an async batch request can be sent with
+const (
+	PriorityHigh   = "high"
+	PriorityNormal = "normal"
+	PriorityLow    = "low"
+)
+
+// All of the priorities, highest first
+var AsyncPriorities = []string{PriorityHigh, PriorityNormal, PriorityLow}
+
+// The ordering guarantees an async batch request can be sent with
+const (
+	OrderingNone        = "none"
+	OrderingPerJob      = "per-job"
+	OrderingPerResource = "per-resource"
+)
+
+// Checks that the ordering is one of the known orderings.  An empty ordering is none.
+func ValidOrdering(ordering string) bool {
+	switch ordering {
+	case "", OrderingNone, OrderingPerJob, OrderingPerResource:
+		return true
+	}
+	return false
+}
+
+// Get the kafka key of an async batch item, and its sequence.  Items with the same key go to the
+// same partition, so they are read in order.  Items with the same sequence are processed one at
+// a time, in the order they were read.  The sequence is empty for items that can run in any order.
+func asyncMessageKey(ordering, requestID, identityID string, batchItem BatchItem) (string, string) {
+	switch ordering {
+	case OrderingPerJob:
+		return requestID, requestID
+	case OrderingPerResource:
+		key := identityID + ":" + batchItem.OrderingKey
+		return key, key
+	}
+	return identityID + batchItem.URL, ""
+}
+
+// Checks that the priority is one of the known priorities.  An empty priority is normal.
+func ValidPriority(priority string) bool {
+	switch priority {
+	case "", PriorityHigh, PriorityNormal, PriorityLow:
+		return true
+	}
+	return false
+}
+
+// Get the kafka topic the async batch items of a priority are sent to
+func PriorityTopic(priority string) string {
+	switch priority {
+	case PriorityHigh:
+		return TOPIC_HIGH
+	case PriorityLow:
+		return TOPIC_LOW
+	}
+	return TOPIC
+}
+
+// Get the kafka consumer group used to read the async batch items of a priority.  Normal
+// priority keeps the original consumer group so its committed offsets carry over.
+func PriorityConsumerGroup(priority string) string {
+	if priority == PriorityHigh || priority == PriorityLow {
+		return CONSUMERGROUP + "_" + priority
+	}
+	return CONSUMERGROUP
+}
+
+// Get how many items of a priority a worker takes relative to the other priorities
+func PriorityWeight(priority string) int {
+	switch priority {
+	case PriorityHigh:
+		return WEIGHT_HIGH
+	case PriorityLow:
+		return WEIGHT_LOW
+	}
+	return WEIGHT_NORMAL
+}
+
+// The messages of a single priority, queued per identity so they can be taken round-robin
+type identityQueue struct {
+	identities []string
+	messages   map[string][]*sarama.ConsumerMessage
+}
+
+func (queue *identityQueue) push(identityID string, message *sarama.ConsumerMessage) {
+	if len(queue.messages[identityID]) == 0 {
+		queue.identities = append(queue.identities, identityID)
+	}
+	queue.messages[identityID] = append(queue.messages[identityID], message)
+}
+
+// Takes the oldest message of the next identity in line, then sends that identity to the back of the line
+func (queue *identityQueue) pop() *sarama.ConsumerMessage {
+	identityID := queue.identities[0]
+	queue.identities = queue.identities[1:]
+
+	messages := queue.messages[identityID]
+	message := messages[0]
+	if len(messages) == 1 {
+		delete(queue.messages, identityID)
+	} else {
+		queue.messages[identityID] = messages[1:]
+		queue.identities = append(queue.identities, identityID)
+	}
+
+	return message
+}
+
+// Buffers the messages read by a worker and hands them out weighted by priority, and round-robin
+// across identities within a priority, so one identity's large batch can't starve the others.
+type fairQueue struct {
+	size    int
+	queues  map[string]*identityQueue
+	current map[string]int
+}
+
+func newFairQueue() *fairQueue {
+	fair := &fairQueue{
+		queues:  map[string]*identityQueue{},
+		current: map[string]int{},
+	}
+	for _, priority := range AsyncPriorities {
+		fair.queues[priority] = &identityQueue{messages: map[string][]*sarama.ConsumerMessage{}}
+	}
+	return fair
+}
+
+// Get the number of buffered messages
+func (fair *fairQueue) Len() int {
+	return fair.size
+}
+
+// Buffers a message read from the consumer for the priority
+func (fair *fairQueue) Push(priority string, message *sarama.ConsumerMessage) {
+	// Messages that can't be read are queued anyway, so the worker can dead letter them
+	envelope, _ := decodeAsyncMessage(message.Value)
+
+	fair.queues[priority].push(envelope.Item.IdentityID, message)
+	fair.size++
+}
+
+// Takes the next message to process, or nil if there are none.  Priorities are picked by a smooth
+// weighted round-robin over the priorities that have messages waiting.
+func (fair *fairQueue) Pop() *sarama.ConsumerMessage {
+	var next string
+	total := 0
+	for _, priority := range AsyncPriorities {
+		if len(fair.queues[priority].identities) == 0 {
+			continue
+		}
+
+		weight := PriorityWeight(priority)
+		total += weight
+		fair.current[priority] += weight
+		if next == "" || fair.current[priority] > fair.current[next] {
+			next = priority
+		}
+	}
+
+	if next == "" {
+		return nil
+	}
+
+	fair.current[next] -= total
+	fair.size--
+	return fair.queues[next].pop()
+}
+
+// The offsets read from a single partition, in the order they were read
+type partitionOffsets struct {
+	pending []int64
+	done    map[int64]*sarama.ConsumerMessage
+}
+
+// Tracks the messages a worker has read so offsets are only committed once every message before
+// them is done, even though the messages finish out of order.
+type offsetTracker struct {
+	partitions map[string]*partitionOffsets
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{partitions: map[string]*partitionOffsets{}}
+}
+
+func partitionKey(message *sarama.ConsumerMessage) string {
+	return fmt.Sprintf("%s/%d", message.Topic, message.Partition)
+}
+
+// Records a message that was read from the consumer
+func (tracker *offsetTracker) Add(message *sarama.ConsumerMessage) {
+	key := partitionKey(message)
+	partition, ok := tracker.partitions[key]
+	if !ok {
+		partition = &partitionOffsets{done: map[int64]*sarama.ConsumerMessage{}}
+		tracker.partitions[key] = partition
+	}
+	partition.pending = append(partition.pending, message.Offset)
+}
+
+// Records a message as done.  Returns the message whose offset can now be committed, or nil if
+// there are still messages before it that aren't done.
+func (tracker *offsetTracker) Done(message *sarama.ConsumerMessage) *sarama.ConsumerMessage {
+	partition, ok := tracker.partitions[partitionKey(message)]
+	if !ok {
+		return nil
+	}
+	partition.done[message.Offset] = message
+
+	var commit *sarama.ConsumerMessage
+	for len(partition.pending) > 0 {
+		doneMessage, ok := partition.done[partition.pending[0]]
+		if !ok {
+			break
+		}
+		commit = doneMessage
+		delete(partition.done, partition.pending[0])
+		partition.pending = partition.pending[1:]
+	}
+
+	return commit
+}
+
+// Checks whether the workers can read more messages.  Messages held back for their sequence don't
+// count against WORKER_BUFFER, so a large ordered job only holds up its own items rather than the
+// reads of every other identity.  They're capped at WORKER_HELD_BUFFER so memory stays bounded.
+func canReadAhead(buffered, held int) bool {
+	return buffered < WORKER_BUFFER && held < WORKER_HELD_BUFFER
+}
+
+// Holds back the messages of a sequence while an earlier message of the same sequence is being
+// processed, so ordered async batch items run one at a time in the order they were read.
+type sequencer struct {
+	size    int
+	busy    map[string]bool
+	waiting map[string][]*sarama.ConsumerMessage
+	ready   []*sarama.ConsumerMessage
+}
+
+func newSequencer() *sequencer {
+	return &sequencer{
+		busy:    map[string]bool{},
+		waiting: map[string][]*sarama.ConsumerMessage{},
+	}
+}
+
+func messageSequence(message *sarama.ConsumerMessage) string {
+	envelope, _ := decodeAsyncMessage(message.Value)
+	return envelope.Item.Sequence
+}
+
+// Get the number of messages being held back
+func (seq *sequencer) Len() int {
+	return seq.size
+}
+
+// Starts processing a message.  Returns false if an earlier message of its sequence is still being
+// processed, in which case the message is held back until that one is done.
+func (seq *sequencer) Start(message *sarama.ConsumerMessage) bool {
+	sequence := messageSequence(message)
+	if sequence == "" {
+		return true
+	} else if seq.busy[sequence] {
+		seq.waiting[sequence] = append(seq.waiting[sequence], message)
+		seq.size++
+		return false
+	}
+
+	seq.busy[sequence] = true
+	return true
+}
+
+// Records a message as done, which lets the next message of its sequence be processed
+func (seq *sequencer) Done(message *sarama.ConsumerMessage) {
+	sequence := messageSequence(message)
+	if sequence == "" {
+		return
+	}
+
+	waiting := seq.waiting[sequence]
+	if len(waiting) == 0 {
+		delete(seq.busy, sequence)
+		return
+	}
+
+	// The sequence stays busy, since the released message is processed next
+	seq.ready = append(seq.ready, waiting[0])
+	if len(waiting) == 1 {
+		delete(seq.waiting, sequence)
+	} else {
+		seq.waiting[sequence] = waiting[1:]
+	}
+}
+
+// Takes the next held back message that can now be processed, or nil if there are none
+func (seq *sequencer) Next() *sarama.ConsumerMessage {
+	if len(seq.ready) == 0 {
+		return nil
+	}
+
+	message := seq.ready[0]
+	seq.ready = seq.ready[1:]
+	seq.size--
+	return message
+}
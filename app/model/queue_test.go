@@ -0,0 +1,225 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+)
+
+// Creates a kafka message holding an async batch item
+func testAsyncMessage(topic string, partition int32, offset int64, identityID, sequence string) *sarama.ConsumerMessage {
+	item := AsyncBatchItem{
+		RequestID:  "request",
+		Index:      offset,
+		IdentityID: identityID,
+		Sequence:   sequence,
+		Item:       BatchItem{Method: "GET", URL: "/"},
+	}
+	return &sarama.ConsumerMessage{
+		Topic:     topic,
+		Partition: partition,
+		Offset:    offset,
+		Value:     encodeAsyncMessage(item, nil),
+	}
+}
+
+func TestFairQueueRoundRobinsIdentities(t *testing.T) {
+	tests := []struct {
+		name       string
+		identities []string
+		expected   []int64
+	}{
+		{"single identity", []string{"a", "a", "a"}, []int64{0, 1, 2}},
+		{"two identities", []string{"a", "a", "a", "b"}, []int64{0, 3, 1, 2}},
+		{"three identities", []string{"a", "a", "b", "b", "c"}, []int64{0, 2, 4, 1, 3}},
+	}
+
+	for _, test := range tests {
+		queue := newFairQueue()
+		for offset, identityID := range test.identities {
+			queue.Push(PriorityNormal, testAsyncMessage(TOPIC, 0, int64(offset), identityID, ""))
+		}
+
+		for idx, expected := range test.expected {
+			message := queue.Pop()
+			if message == nil {
+				t.Fatalf("%s: pop %d returned nothing, expected offset %d", test.name, idx, expected)
+			} else if message.Offset != expected {
+				t.Errorf("%s: pop %d returned offset %d, expected %d", test.name, idx, message.Offset, expected)
+			}
+		}
+
+		if message := queue.Pop(); message != nil {
+			t.Errorf("%s: expected the queue to be empty, got offset %d", test.name, message.Offset)
+		} else if queue.Len() != 0 {
+			t.Errorf("%s: expected a length of 0, got %d", test.name, queue.Len())
+		}
+	}
+}
+
+func TestFairQueueWeighsPriorities(t *testing.T) {
+	tests := []struct {
+		name     string
+		pushed   map[string]int
+		pops     int
+		expected map[string]int
+	}{
+		{"high and low", map[string]int{PriorityHigh: 10, PriorityLow: 10}, 7, map[string]int{PriorityHigh: 6, PriorityLow: 1}},
+		{"high and normal", map[string]int{PriorityHigh: 10, PriorityNormal: 10}, 9, map[string]int{PriorityHigh: 6, PriorityNormal: 3}},
+		{"all priorities", map[string]int{PriorityHigh: 10, PriorityNormal: 10, PriorityLow: 10}, 10, map[string]int{PriorityHigh: 6, PriorityNormal: 3, PriorityLow: 1}},
+		{"only low", map[string]int{PriorityLow: 3}, 3, map[string]int{PriorityLow: 3}},
+		{"high runs out", map[string]int{PriorityHigh: 1, PriorityLow: 5}, 6, map[string]int{PriorityHigh: 1, PriorityLow: 5}},
+	}
+
+	for _, test := range tests {
+		queue := newFairQueue()
+		topics := map[string]string{}
+		for priority, count := range test.pushed {
+			topics[PriorityTopic(priority)] = priority
+			for offset := 0; offset < count; offset++ {
+				queue.Push(priority, testAsyncMessage(PriorityTopic(priority), 0, int64(offset), "identity", ""))
+			}
+		}
+
+		popped := map[string]int{}
+		for idx := 0; idx < test.pops; idx++ {
+			message := queue.Pop()
+			if message == nil {
+				t.Fatalf("%s: pop %d returned nothing", test.name, idx)
+			}
+			popped[topics[message.Topic]]++
+		}
+
+		for _, priority := range AsyncPriorities {
+			if popped[priority] != test.expected[priority] {
+				t.Errorf("%s: popped %d %s priority messages, expected %d", test.name, popped[priority], priority, test.expected[priority])
+			}
+		}
+	}
+}
+
+func TestOffsetTrackerCommitsInOrder(t *testing.T) {
+	tests := []struct {
+		name     string
+		read     []int64
+		done     []int64
+		expected []int64 // The offset committed after each done message, -1 for none
+	}{
+		{"in order", []int64{1, 2, 3}, []int64{1, 2, 3}, []int64{1, 2, 3}},
+		{"reversed", []int64{1, 2, 3}, []int64{3, 2, 1}, []int64{-1, -1, 3}},
+		{"gap in the middle", []int64{1, 2, 3, 4}, []int64{1, 3, 4, 2}, []int64{1, -1, -1, 4}},
+		{"first done last", []int64{5, 6}, []int64{6, 5}, []int64{-1, 6}},
+	}
+
+	for _, test := range tests {
+		tracker := newOffsetTracker()
+		for _, offset := range test.read {
+			tracker.Add(testAsyncMessage(TOPIC, 0, offset, "identity", ""))
+		}
+
+		for idx, offset := range test.done {
+			commit := tracker.Done(testAsyncMessage(TOPIC, 0, offset, "identity", ""))
+			if test.expected[idx] < 0 && commit != nil {
+				t.Errorf("%s: done %d committed offset %d, expected nothing", test.name, offset, commit.Offset)
+			} else if test.expected[idx] >= 0 && (commit == nil || commit.Offset != test.expected[idx]) {
+				t.Errorf("%s: done %d committed %v, expected offset %d", test.name, offset, commit, test.expected[idx])
+			}
+		}
+	}
+}
+
+func TestOffsetTrackerKeepsPartitionsApart(t *testing.T) {
+	tracker := newOffsetTracker()
+	tracker.Add(testAsyncMessage(TOPIC, 0, 1, "identity", ""))
+	tracker.Add(testAsyncMessage(TOPIC, 1, 1, "identity", ""))
+	tracker.Add(testAsyncMessage(TOPIC_HIGH, 0, 1, "identity", ""))
+
+	if commit := tracker.Done(testAsyncMessage(TOPIC, 1, 1, "identity", "")); commit == nil || commit.Partition != 1 {
+		t.Errorf("Expected partition 1 to be committed on its own, got %v", commit)
+	}
+	if commit := tracker.Done(testAsyncMessage(TOPIC_HIGH, 0, 1, "identity", "")); commit == nil || commit.Topic != TOPIC_HIGH {
+		t.Errorf("Expected topic %s to be committed on its own, got %v", TOPIC_HIGH, commit)
+	}
+	if commit := tracker.Done(testAsyncMessage(TOPIC, 2, 1, "identity", "")); commit != nil {
+		t.Errorf("Expected a partition that was never read not to be committed, got %v", commit)
+	}
+}
+
+func TestSequencerHoldsBackSequences(t *testing.T) {
+	first := testAsyncMessage(TOPIC, 0, 1, "identity", "a")
+	second := testAsyncMessage(TOPIC, 0, 2, "identity", "a")
+	third := testAsyncMessage(TOPIC, 0, 3, "identity", "a")
+	other := testAsyncMessage(TOPIC, 0, 4, "identity", "b")
+	unordered := testAsyncMessage(TOPIC, 0, 5, "identity", "")
+
+	seq := newSequencer()
+	tests := []struct {
+		name    string
+		message *sarama.ConsumerMessage
+		started bool
+	}{
+		{"first of a sequence", first, true},
+		{"second of a busy sequence", second, false},
+		{"third of a busy sequence", third, false},
+		{"another sequence", other, true},
+		{"no sequence", unordered, true},
+		{"no sequence again", unordered, true},
+	}
+	for _, test := range tests {
+		if started := seq.Start(test.message); started != test.started {
+			t.Errorf("%s: started %t, expected %t", test.name, started, test.started)
+		}
+	}
+
+	if seq.Len() != 2 {
+		t.Errorf("Expected 2 held back messages, got %d", seq.Len())
+	} else if next := seq.Next(); next != nil {
+		t.Errorf("Expected nothing to be ready before the sequence is done, got offset %d", next.Offset)
+	}
+
+	seq.Done(unordered)
+	seq.Done(other)
+	if next := seq.Next(); next != nil {
+		t.Errorf("Expected other sequences finishing not to release anything, got offset %d", next.Offset)
+	}
+
+	for _, expected := range []*sarama.ConsumerMessage{first, second} {
+		seq.Done(expected)
+		if next := seq.Next(); next == nil || next.Offset != expected.Offset+1 {
+			t.Errorf("Expected offset %d to be released after %d is done, got %v", expected.Offset+1, expected.Offset, next)
+		}
+	}
+
+	if seq.Len() != 0 {
+		t.Errorf("Expected no held back messages, got %d", seq.Len())
+	}
+
+	seq.Done(third)
+	if !seq.Start(testAsyncMessage(TOPIC, 0, 6, "identity", "a")) {
+		t.Errorf("Expected the sequence to be free once all of its messages are done")
+	}
+}
+
+func TestCanReadAhead(t *testing.T) {
+	defer func(buffer, held int) { WORKER_BUFFER, WORKER_HELD_BUFFER = buffer, held }(WORKER_BUFFER, WORKER_HELD_BUFFER)
+	WORKER_BUFFER, WORKER_HELD_BUFFER = 10, 100
+
+	tests := []struct {
+		name     string
+		buffered int
+		held     int
+		expected bool
+	}{
+		{"empty", 0, 0, true},
+		{"buffer full", 10, 0, false},
+		{"many held back", 5, 50, true},
+		{"held back past the buffer size", 0, 99, true},
+		{"held back full", 0, 100, false},
+	}
+
+	for _, test := range tests {
+		if read := canReadAhead(test.buffered, test.held); read != test.expected {
+			t.Errorf("%s: read %t, expected %t", test.name, read, test.expected)
+		}
+	}
+}
@@ -2,9 +2,43 @@ package model
 
 import (
 	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
 	"gopkg.in/redis.v2"
 )
 
+// Identifies this process when it holds a lock in redis
+var InstanceID string = newInstanceID()
+
+// Takes a lock, or extends it if this holder already has it.  Returns 1 if the lock is held.
+const acquireLockScript = `
+local holder = redis.call("GET", KEYS[1])
+if holder == ARGV[1] then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+	return 1
+elseif not holder then
+	redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+	return 1
+end
+return 0
+`
+
+// Sets a key only if it doesn't exist yet.  Unlike a lock, the holder that set it can't take it again.
+const setOnceScript = `
+return redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2])
+`
+
+// Releases a lock, only if this holder still has it
+const releaseLockScript = `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`
+
 // Used to retrieve a new Redis client
 var NewRedisClient = func(host, port, password, db string) *redis.Client {
 	return redis.NewTCPClient(&redis.Options{
@@ -13,3 +47,60 @@ var NewRedisClient = func(host, port, password, db string) *redis.Client {
 		DB:       int64(REDIS_DB),
 	})
 }
+
+func newInstanceID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s:%d", hostname, os.Getpid())
+}
+
+// Checks if the error is because the key or field asked for doesn't exist
+func IsRedisNil(err error) bool {
+	return err == redis.Nil
+}
+
+// Creates a sorted set member.  Useful where a redis client variable hides the package name.
+func redisZ(score float64, member string) redis.Z {
+	return redis.Z{Score: score, Member: member}
+}
+
+// Takes the lock at key for holder, or extends it if holder already has it
+func AcquireRedisLock(redis *redis.Client, key, holder string, ttl time.Duration) (bool, error) {
+	lockCmd := redis.Eval(acquireLockScript, []string{key}, []string{holder, strconv.FormatInt(int64(ttl/time.Millisecond), 10)})
+	lockResult, err := lockCmd.Result()
+	if err != nil {
+		countRedisError("lock")
+		log.Printf("An error occurred acquiring lock in Redis: [key: %s] [holder: %s] (error: %s)", key, holder, err)
+		return false, err
+	}
+
+	acquired, _ := lockResult.(int64)
+	return acquired == 1, nil
+}
+
+// Sets key to holder if nobody has set it yet.  Returns false if it was already set, even by holder,
+// so it guards something that must only happen once.
+func SetRedisOnce(redis *redis.Client, key, holder string, ttl time.Duration) (bool, error) {
+	setCmd := redis.Eval(setOnceScript, []string{key}, []string{holder, strconv.FormatInt(int64(ttl/time.Millisecond), 10)})
+	if _, err := setCmd.Result(); IsRedisNil(err) {
+		return false, nil
+	} else if err != nil {
+		countRedisError("lock")
+		log.Printf("An error occurred setting key once in Redis: [key: %s] [holder: %s] (error: %s)", key, holder, err)
+		return false, err
+	}
+	return true, nil
+}
+
+// Releases the lock at key, if holder still has it
+func ReleaseRedisLock(redis *redis.Client, key, holder string) error {
+	unlockCmd := redis.Eval(releaseLockScript, []string{key}, []string{holder})
+	if _, err := unlockCmd.Result(); err != nil {
+		countRedisError("lock")
+		log.Printf("An error occurred releasing lock in Redis: [key: %s] [holder: %s] (error: %s)", key, holder, err)
+		return err
+	}
+	return nil
+}
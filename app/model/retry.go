@@ -0,0 +1,195 @@
+package model
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/Shopify/sarama"
+	"gopkg.in/redis.v2"
+)
+
+// Resets the results of items of a completed async batch job so they can be ran again, and puts
+// the job back to pending.  Each item's attempt count goes up, and its claim is cleared so the
+// next claim isn't counted as a take-over.  Every KEY is kept for another ARGV[1] seconds, and
+// the rest of ARGV are the indexes.  Returns -1 if the job isn't complete.
+const resetItemsScript = `
+if redis.call("HGET", KEYS[1], "status") ~= "complete" then
+	return -1
+end
+for i = 2, #ARGV do
+	redis.call("LSET", KEYS[2], ARGV[i], "")
+	if redis.call("HINCRBY", KEYS[3], ARGV[i], 1) == 1 then
+		redis.call("HINCRBY", KEYS[3], ARGV[i], 1)
+	end
+	redis.call("HDEL", KEYS[4], ARGV[i])
+end
+redis.call("HINCRBY", KEYS[1], "completed", 1 - #ARGV)
+redis.call("HSET", KEYS[1], "status", "pending")
+redis.call("HDEL", KEYS[1], "completedAt")
+local callbackURL = redis.call("HGET", KEYS[1], "callbackUrl")
+if callbackURL and callbackURL ~= "" then
+	redis.call("HSET", KEYS[1], "callbackStatus", "pending")
+end
+for _, key in ipairs(KEYS) do
+	redis.call("EXPIRE", key, ARGV[1])
+end
+return #ARGV - 1
+`
+
+// Options for retrying the failed items of an async batch job
+type AsyncRetryRequest struct {
+	Codes []int `json:"codes"`
+}
+
+// The items of an async batch job that were sent to the workers again
+type AsyncRetry struct {
+	RequestID string  `json:"requestId"`
+	Retried   int     `json:"retried"`
+	Indexes   []int64 `json:"indexes"`
+}
+
+// Get the redis key holding how many times each item of an async batch job has been ran
+func AsyncJobAttemptsKey(requestID string) string {
+	return requestID + ":attempts"
+}
+
+// Checks whether an item's result should be retried.  Only 5xx responses, and transport errors
+// which are saved as 500s, are retried.  If codes are given only those codes are retried.
+func (retry AsyncRetryRequest) Match(response BatchResponseItem) bool {
+	if response.Code != 0 && response.Code < 500 {
+		return false
+	} else if len(retry.Codes) == 0 {
+		return true
+	}
+
+	for _, code := range retry.Codes {
+		if response.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the indexes of the items of an async batch job whose results should be retried
+func retryableAsyncItems(redis *redis.Client, requestID string, retry AsyncRetryRequest) ([]int64, error) {
+	indexes := []int64{}
+	for start := int64(0); ; start += ASYNC_PAGE_MAX_LIMIT {
+		resultsCmd := redis.LRange(requestID, start, start+ASYNC_PAGE_MAX_LIMIT-1)
+		results, err := resultsCmd.Result()
+		if err != nil {
+			log.Printf("An error occurred getting async results from Redis: [request id: %s] (error: %s)", requestID, err)
+			return nil, fmt.Errorf("An internal server error occurred.")
+		}
+
+		for idx, result := range results {
+			index := start + int64(idx)
+			if result == "" {
+				continue
+			}
+
+			response, err := unmarshalAsyncResult(requestID, index, result)
+			if err != nil {
+				return nil, err
+			} else if retry.Match(response) {
+				indexes = append(indexes, index)
+			}
+		}
+
+		if int64(len(results)) < ASYNC_PAGE_MAX_LIMIT {
+			return indexes, nil
+		}
+	}
+}
+
+// Sends the failed items of a completed async batch job of an identity to the workers again.
+// Their results are reset and the job goes back to pending until they're done.
+func RetryAsyncJobItems(identityID, requestID string, retry AsyncRetryRequest) (AsyncRetry, error) {
+	redis := GetAsyncJobRedis()
+	defer redis.Close()
+
+	job, err := GetIdentityAsyncJob(redis, identityID, requestID)
+	if err != nil {
+		return AsyncRetry{}, err
+	} else if job.Status != AsyncJobComplete {
+		return AsyncRetry{}, fmt.Errorf("Only completed async batch requests can be retried.")
+	}
+
+	indexes, err := retryableAsyncItems(redis, requestID, retry)
+	if err != nil {
+		return AsyncRetry{}, err
+	} else if len(indexes) == 0 {
+		return AsyncRetry{RequestID: requestID, Indexes: indexes}, nil
+	}
+
+	batchItems, err := getAsyncJobItems(redis, requestID)
+	if err != nil {
+		return AsyncRetry{}, fmt.Errorf("An internal server error occurred.")
+	} else if int64(len(batchItems)) != job.Total {
+		return AsyncRetry{}, fmt.Errorf("The batch items of the async batch request weren't saved, so it can't be retried.")
+	}
+
+	keys := append([]string{
+		AsyncJobKey(requestID),
+		requestID,
+		AsyncJobAttemptsKey(requestID),
+		AsyncJobClaimsKey(requestID),
+	}, AsyncJobKeys(requestID)...)
+	args := []string{strconv.Itoa(ASYNC_EXPIRE * 60)}
+	for _, index := range indexes {
+		args = append(args, strconv.FormatInt(index, 10))
+	}
+
+	resetCmd := redis.Eval(resetItemsScript, keys, args)
+	resetResult, err := resetCmd.Result()
+	if err != nil {
+		countRedisError("reset_items")
+		log.Printf("An error occurred resetting async batch items in Redis: [request id: %s] (error: %s)", requestID, err)
+		return AsyncRetry{}, fmt.Errorf("An internal server error occurred.")
+	} else if reset, _ := resetResult.(int64); reset < 0 {
+		return AsyncRetry{}, fmt.Errorf("Only completed async batch requests can be retried.")
+	}
+
+	messages := make([]*sarama.ProducerMessage, len(indexes))
+	for idx, index := range indexes {
+		messages[idx] = asyncItemMessage(job, index, batchItems[index])
+	}
+
+	if err := sendAsyncItems(job, messages); err != nil {
+		FailAsyncJob(redis, requestID, "Not all of the retried batch items could be sent to the workers.")
+		return AsyncRetry{}, err
+	}
+
+	log.Printf("Async job items retried: [request id: %s] [items: %d]", requestID, len(indexes))
+	return AsyncRetry{RequestID: requestID, Retried: len(indexes), Indexes: indexes}, nil
+}
+
+// Get how many times each of the items of an async batch job has been ran.  Items that were
+// never retried have ran once.
+func getAsyncItemAttempts(redis *redis.Client, requestID string, indexes []int64) []int64 {
+	attempts := make([]int64, len(indexes))
+	fields := make([]string, len(indexes))
+	for idx, index := range indexes {
+		attempts[idx] = 1
+		fields[idx] = strconv.FormatInt(index, 10)
+	}
+	if len(fields) == 0 {
+		return attempts
+	}
+
+	getCmd := redis.HMGet(AsyncJobAttemptsKey(requestID), fields...)
+	values, err := getCmd.Result()
+	if err != nil {
+		log.Printf("An error occurred getting async item attempts from Redis: [request id: %s] (error: %s)", requestID, err)
+		return attempts
+	}
+
+	for idx, value := range values {
+		if value, ok := value.(string); ok {
+			if count, err := strconv.ParseInt(value, 10, 64); err == nil {
+				attempts[idx] = count
+			}
+		}
+	}
+	return attempts
+}
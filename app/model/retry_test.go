@@ -0,0 +1,92 @@
+package model
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestAsyncRetryRequestMatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		retry    AsyncRetryRequest
+		code     int
+		expected bool
+	}{
+		{"success", AsyncRetryRequest{}, 200, false},
+		{"client error", AsyncRetryRequest{}, 404, false},
+		{"server error", AsyncRetryRequest{}, 500, true},
+		{"bad gateway", AsyncRetryRequest{}, 502, true},
+		{"no code", AsyncRetryRequest{}, 0, true},
+		{"listed code", AsyncRetryRequest{Codes: []int{502, 503}}, 503, true},
+		{"unlisted code", AsyncRetryRequest{Codes: []int{502, 503}}, 500, false},
+		{"listed client error", AsyncRetryRequest{Codes: []int{404}}, 404, false},
+	}
+
+	for _, test := range tests {
+		if matched := test.retry.Match(BatchResponseItem{Code: test.code}); matched != test.expected {
+			t.Errorf("%s: matched %t, expected %t", test.name, matched, test.expected)
+		}
+	}
+}
+
+func TestResetAsyncItems(t *testing.T) {
+	redis := testRedis(t)
+	defer redis.Close()
+
+	requestID := testAsyncJob(t, redis, AsyncJobComplete, "ok", "failed", "failed")
+	redis.HSet(AsyncJobClaimsKey(requestID), "1", "holder")
+	redis.HSet(AsyncJobAttemptsKey(requestID), "2", "2")
+
+	keys := append([]string{
+		AsyncJobKey(requestID),
+		requestID,
+		AsyncJobAttemptsKey(requestID),
+		AsyncJobClaimsKey(requestID),
+	}, AsyncJobKeys(requestID)...)
+	args := []string{strconv.Itoa(ASYNC_EXPIRE * 60), "1", "2"}
+
+	reset, err := redis.Eval(resetItemsScript, keys, args).Result()
+	if err != nil {
+		t.Fatalf("Unable to reset the items: %s", err)
+	} else if reset, _ := reset.(int64); reset != 2 {
+		t.Errorf("Expected 2 items to be reset, got %d", reset)
+	}
+
+	job, err := GetAsyncJob(redis, requestID)
+	if err != nil {
+		t.Fatalf("Unable to get the job: %s", err)
+	} else if job.Status != AsyncJobPending {
+		t.Errorf("Expected the job to be pending again, got %s", job.Status)
+	} else if job.Completed != 1 {
+		t.Errorf("Expected 1 item to still be completed, got %d", job.Completed)
+	}
+
+	tests := []struct {
+		index    int64
+		result   string
+		attempts string
+	}{
+		{0, "ok", ""},
+		{1, "", "2"},
+		{2, "", "3"},
+	}
+	for _, test := range tests {
+		index := strconv.FormatInt(test.index, 10)
+		if result, _ := redis.LIndex(requestID, test.index).Result(); result != test.result {
+			t.Errorf("Item %d: result %q, expected %q", test.index, result, test.result)
+		}
+		if attempts, _ := redis.HGet(AsyncJobAttemptsKey(requestID), index).Result(); attempts != test.attempts {
+			t.Errorf("Item %d: attempts %q, expected %q", test.index, attempts, test.attempts)
+		}
+		if exists, _ := redis.HExists(AsyncJobClaimsKey(requestID), index).Result(); exists {
+			t.Errorf("Item %d: expected its claim to be cleared", test.index)
+		}
+	}
+
+	// Only completed jobs are reset
+	if reset, err := redis.Eval(resetItemsScript, keys, args).Result(); err != nil {
+		t.Fatalf("Unable to reset the items: %s", err)
+	} else if reset, _ := reset.(int64); reset != -1 {
+		t.Errorf("Expected a pending job not to be reset, got %d", reset)
+	}
+}
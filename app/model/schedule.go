@@ -0,0 +1,335 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/pborman/uuid"
+	"github.com/robfig/cron"
+	"gopkg.in/redis.v2"
+)
+
+var SCHEDULE_POLL int = 5000
+var SCHEDULE_LOCK_TTL int = 30
+var SCHEDULE_HISTORY int64 = 20
+
+// The hash of recurring batch schedules, keyed by schedule ID
+const batchSchedulesKey = "batch:schedules"
+
+// The lock held by the worker that triggers the recurring batch schedules
+const batchScheduleLeaderKey = "batch:schedules:leader"
+
+// A batch that is ran asynchronously on a cron schedule
+type BatchSchedule struct {
+	ID         string            `json:"id"`
+	Cron       string            `json:"cron"`
+	IdentityID string            `json:"identityId"`
+	Batch      AsyncBatchRequest `json:"batch"`
+	Created    time.Time         `json:"created"`
+	Updated    time.Time         `json:"updated"`
+	LastRun    *time.Time        `json:"lastRun,omitempty"`
+	NextRun    time.Time         `json:"nextRun"`
+	Runs       []string          `json:"runs"`
+}
+
+// Get the redis key holding the request IDs of the recent runs of a schedule
+func batchScheduleRunsKey(scheduleID string) string {
+	return "batch:schedule:" + scheduleID + ":runs"
+}
+
+// Get the redis key used to make sure a single run of a schedule only happens once
+func batchScheduleRunKey(scheduleID string, runAt time.Time) string {
+	return fmt.Sprintf("batch:schedule:%s:run:%d", scheduleID, runAt.Unix())
+}
+
+// Parses a standard 5 field cron expression
+func ParseCron(spec string) (cron.Schedule, error) {
+	schedule, err := cron.ParseStandard(spec)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid cron expression: %s (%s)", spec, err)
+	}
+	return schedule, nil
+}
+
+// Saves the schedule, without its run history
+func saveBatchSchedule(redis *redis.Client, schedule BatchSchedule) error {
+	schedule.Runs = nil
+	output, _ := json.Marshal(schedule)
+
+	saveCmd := redis.HSet(batchSchedulesKey, schedule.ID, string(output))
+	if _, err := saveCmd.Result(); err != nil {
+		log.Printf("An error occurred saving batch schedule to Redis: [schedule id: %s] (error: %s)", schedule.ID, err)
+		return fmt.Errorf("An internal server error occurred.")
+	}
+	return nil
+}
+
+// Reads a saved schedule
+func loadBatchSchedule(scheduleID, data string) (BatchSchedule, error) {
+	var schedule BatchSchedule
+	if err := json.Unmarshal([]byte(data), &schedule); err != nil {
+		log.Printf("This shouldn't happen. We put this JSON into Redis and it should always be properly formatted. [schedule id: %s] (error: %s)", scheduleID, err)
+		return BatchSchedule{}, fmt.Errorf("An internal server error occurred.")
+	}
+	return schedule, nil
+}
+
+// Adds the request IDs of the recent runs to the schedule
+func loadBatchScheduleRuns(redis *redis.Client, schedule *BatchSchedule) {
+	runsCmd := redis.LRange(batchScheduleRunsKey(schedule.ID), 0, -1)
+	runs, err := runsCmd.Result()
+	if err != nil {
+		log.Printf("An error occurred getting batch schedule runs from Redis: [schedule id: %s] (error: %s)", schedule.ID, err)
+	}
+
+	schedule.Runs = runs
+	if schedule.Runs == nil {
+		schedule.Runs = []string{}
+	}
+}
+
+// Creates a new recurring batch schedule
+func CreateBatchSchedule(identityID, spec string, batch AsyncBatchRequest) (BatchSchedule, error) {
+	cronSchedule, err := ParseCron(spec)
+	if err != nil {
+		return BatchSchedule{}, err
+	}
+
+	now := time.Now()
+	schedule := BatchSchedule{
+		ID:         uuid.New(),
+		Cron:       spec,
+		IdentityID: identityID,
+		Batch:      batch,
+		Created:    now,
+		Updated:    now,
+		NextRun:    cronSchedule.Next(now),
+		Runs:       []string{},
+	}
+
+	redis := GetAsyncJobRedis()
+	defer redis.Close()
+
+	if err := saveBatchSchedule(redis, schedule); err != nil {
+		return BatchSchedule{}, err
+	}
+
+	log.Printf("Batch schedule created: [schedule id: %s] [cron: %s] [next run: %s]", schedule.ID, schedule.Cron, schedule.NextRun)
+	return schedule, nil
+}
+
+// Gets a recurring batch schedule.  Schedules belonging to other identities are not found.
+func GetBatchSchedule(identityID, scheduleID string) (BatchSchedule, error) {
+	redis := GetAsyncJobRedis()
+	defer redis.Close()
+
+	getCmd := redis.HGet(batchSchedulesKey, scheduleID)
+	data, err := getCmd.Result()
+	if IsRedisNil(err) {
+		return BatchSchedule{}, fmt.Errorf("The batch schedule can not be found.")
+	} else if err != nil {
+		log.Printf("An error occurred getting batch schedule from Redis: [schedule id: %s] (error: %s)", scheduleID, err)
+		return BatchSchedule{}, fmt.Errorf("An internal server error occurred.")
+	}
+
+	schedule, err := loadBatchSchedule(scheduleID, data)
+	if err != nil {
+		return BatchSchedule{}, err
+	} else if schedule.IdentityID != identityID {
+		return BatchSchedule{}, fmt.Errorf("The batch schedule can not be found.")
+	}
+
+	loadBatchScheduleRuns(redis, &schedule)
+	return schedule, nil
+}
+
+// Lists all of the recurring batch schedules for an identity
+func ListBatchSchedules(identityID string) ([]BatchSchedule, error) {
+	redis := GetAsyncJobRedis()
+	defer redis.Close()
+
+	schedules, err := listBatchSchedules(redis, func(schedule BatchSchedule) bool {
+		return schedule.IdentityID == identityID
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for idx := range schedules {
+		loadBatchScheduleRuns(redis, &schedules[idx])
+	}
+	return schedules, nil
+}
+
+// Lists the recurring batch schedules that match the filter
+func listBatchSchedules(redis *redis.Client, filter func(BatchSchedule) bool) ([]BatchSchedule, error) {
+	getCmd := redis.HGetAllMap(batchSchedulesKey)
+	all, err := getCmd.Result()
+	if err != nil {
+		log.Printf("An error occurred getting batch schedules from Redis: %s", err)
+		return nil, fmt.Errorf("An internal server error occurred.")
+	}
+
+	schedules := []BatchSchedule{}
+	for scheduleID, data := range all {
+		schedule, err := loadBatchSchedule(scheduleID, data)
+		if err != nil || !filter(schedule) {
+			continue
+		}
+		schedules = append(schedules, schedule)
+	}
+
+	return schedules, nil
+}
+
+// Replaces the cron expression and batch of a recurring batch schedule
+func UpdateBatchSchedule(identityID, scheduleID, spec string, batch AsyncBatchRequest) (BatchSchedule, error) {
+	cronSchedule, err := ParseCron(spec)
+	if err != nil {
+		return BatchSchedule{}, err
+	}
+
+	schedule, err := GetBatchSchedule(identityID, scheduleID)
+	if err != nil {
+		return BatchSchedule{}, err
+	}
+
+	schedule.Cron = spec
+	schedule.Batch = batch
+	schedule.Updated = time.Now()
+	schedule.NextRun = cronSchedule.Next(schedule.Updated)
+
+	redis := GetAsyncJobRedis()
+	defer redis.Close()
+
+	if err := saveBatchSchedule(redis, schedule); err != nil {
+		return BatchSchedule{}, err
+	}
+
+	log.Printf("Batch schedule updated: [schedule id: %s] [cron: %s] [next run: %s]", schedule.ID, schedule.Cron, schedule.NextRun)
+	return schedule, nil
+}
+
+// Deletes a recurring batch schedule, along with its run history
+func DeleteBatchSchedule(identityID, scheduleID string) error {
+	if _, err := GetBatchSchedule(identityID, scheduleID); err != nil {
+		return err
+	}
+
+	redis := GetAsyncJobRedis()
+	defer redis.Close()
+
+	delCmd := redis.HDel(batchSchedulesKey, scheduleID)
+	if _, err := delCmd.Result(); err != nil {
+		log.Printf("An error occurred deleting batch schedule from Redis: [schedule id: %s] (error: %s)", scheduleID, err)
+		return fmt.Errorf("An internal server error occurred.")
+	}
+	redis.Del(batchScheduleRunsKey(scheduleID))
+
+	log.Printf("Batch schedule deleted: [schedule id: %s]", scheduleID)
+	return nil
+}
+
+// Runs a single schedule if it's due, and moves it to its next run
+func runBatchSchedule(redis *redis.Client, schedule BatchSchedule, now time.Time) {
+	if now.Before(schedule.NextRun) {
+		return
+	}
+
+	cronSchedule, err := ParseCron(schedule.Cron)
+	if err != nil {
+		log.Printf("Skipping batch schedule with invalid cron: [schedule id: %s] (error: %s)", schedule.ID, err)
+		return
+	}
+
+	runAt := schedule.NextRun
+	schedule.LastRun = &runAt
+	schedule.NextRun = cronSchedule.Next(now)
+
+	// Guards against a run happening twice if the leader changes in the middle of a run, or the
+	// same leader comes back to it before the schedule is saved
+	ttl := schedule.NextRun.Sub(now) + time.Hour
+	if set, err := SetRedisOnce(redis, batchScheduleRunKey(schedule.ID, runAt), InstanceID, ttl); err != nil {
+		return
+	} else if !set {
+		// An earlier leader started this run but may not have lived to move the schedule on
+		log.Printf("Batch schedule already ran: [schedule id: %s] [run at: %s] [next run: %s]", schedule.ID, runAt, schedule.NextRun)
+		advanceBatchSchedule(redis, schedule)
+		return
+	}
+
+	requestID, err := schedule.Batch.Items.RunBatchAsync(context.Background(), schedule.IdentityID, schedule.Batch.AsyncBatchOptions)
+	if err != nil {
+		log.Printf("An error occurred running batch schedule: [schedule id: %s] [run at: %s] (error: %s)", schedule.ID, runAt, err)
+	} else {
+		log.Printf("Batch schedule ran: [schedule id: %s] [run at: %s] [request id: %s] [next run: %s]", schedule.ID, runAt, requestID, schedule.NextRun)
+		redis.LPush(batchScheduleRunsKey(schedule.ID), requestID)
+		redis.LTrim(batchScheduleRunsKey(schedule.ID), 0, SCHEDULE_HISTORY-1)
+	}
+
+	advanceBatchSchedule(redis, schedule)
+}
+
+// Saves a schedule moved on to its next run, unless it was changed or deleted while it was running
+func advanceBatchSchedule(redis *redis.Client, schedule BatchSchedule) {
+	getCmd := redis.HGet(batchSchedulesKey, schedule.ID)
+	if data, err := getCmd.Result(); err != nil {
+		return
+	} else if current, err := loadBatchSchedule(schedule.ID, data); err != nil || !current.Updated.Equal(schedule.Updated) {
+		return
+	}
+
+	saveBatchSchedule(redis, schedule)
+}
+
+// Starts the background task that runs the recurring batch schedules.  Every worker
+// runs this, but only the one holding the leader lock in redis triggers the runs.
+func StartBatchScheduleRunner(quit chan bool, finished chan bool) {
+	redis := GetAsyncJobRedis()
+	defer redis.Close()
+
+	lockTTL := time.Duration(SCHEDULE_LOCK_TTL) * time.Second
+	leader := false
+
+	log.Printf("Batch schedule runner started: [instance: %s]", InstanceID)
+
+	ticker := time.NewTicker(time.Duration(SCHEDULE_POLL) * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-quit:
+			log.Println("Interrupt detected. Stopping batch schedule runner")
+			if leader {
+				ReleaseRedisLock(redis, batchScheduleLeaderKey, InstanceID)
+			}
+			finished <- true
+			return
+		case <-ticker.C:
+			acquired, err := AcquireRedisLock(redis, batchScheduleLeaderKey, InstanceID, lockTTL)
+			if err != nil {
+				continue
+			} else if acquired != leader {
+				log.Printf("Batch schedule runner leadership changed: [instance: %s] [leader: %t]", InstanceID, acquired)
+				leader = acquired
+			}
+
+			if !leader {
+				continue
+			}
+
+			schedules, err := listBatchSchedules(redis, func(BatchSchedule) bool { return true })
+			if err != nil {
+				continue
+			}
+
+			now := time.Now()
+			for _, schedule := range schedules {
+				runBatchSchedule(redis, schedule, now)
+			}
+		}
+	}
+}
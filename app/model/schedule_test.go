@@ -0,0 +1,92 @@
+package model
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pborman/uuid"
+)
+
+func TestParseCron(t *testing.T) {
+	from := time.Date(2020, 1, 1, 10, 30, 0, 0, time.UTC)
+	tests := []struct {
+		spec     string
+		valid    bool
+		expected time.Time
+	}{
+		{"0 * * * *", true, time.Date(2020, 1, 1, 11, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", true, time.Date(2020, 1, 1, 10, 45, 0, 0, time.UTC)},
+		{"0 0 * * *", true, time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{"not a cron", false, time.Time{}},
+		{"* * * *", false, time.Time{}},
+	}
+
+	for _, test := range tests {
+		schedule, err := ParseCron(test.spec)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: valid %t, expected %t (error: %v)", test.spec, err == nil, test.valid, err)
+		} else if test.valid && !schedule.Next(from).Equal(test.expected) {
+			t.Errorf("%s: next run %s, expected %s", test.spec, schedule.Next(from), test.expected)
+		}
+	}
+}
+
+func TestSetRedisOnce(t *testing.T) {
+	redis := testRedis(t)
+	defer redis.Close()
+
+	key := "test:once:" + uuid.New()
+	defer redis.Del(key)
+
+	for idx, expected := range []bool{true, false} {
+		if set, err := SetRedisOnce(redis, key, InstanceID, time.Minute); err != nil || set != expected {
+			t.Errorf("Set %d: set %t, expected %t (error: %v)", idx, set, expected, err)
+		}
+	}
+}
+
+func TestRunBatchScheduleAlreadyRan(t *testing.T) {
+	redis := testRedis(t)
+	defer redis.Close()
+
+	now := time.Now().Truncate(time.Second)
+	runAt := now.Add(-time.Minute)
+	schedule := BatchSchedule{
+		ID:         "test:" + uuid.New(),
+		Cron:       "* * * * *",
+		IdentityID: "identity",
+		Created:    now.Add(-time.Hour),
+		Updated:    now.Add(-time.Hour),
+		NextRun:    runAt,
+	}
+	defer redis.HDel(batchSchedulesKey, schedule.ID)
+	defer redis.Del(batchScheduleRunKey(schedule.ID, runAt), batchScheduleRunsKey(schedule.ID))
+
+	if err := saveBatchSchedule(redis, schedule); err != nil {
+		t.Fatalf("Unable to save the schedule: %s", err)
+	}
+
+	// Another leader started the run, but didn't move the schedule on
+	if set, err := SetRedisOnce(redis, batchScheduleRunKey(schedule.ID, runAt), "other", time.Hour); err != nil || !set {
+		t.Fatalf("Unable to set the run guard: %v", err)
+	}
+
+	runBatchSchedule(redis, schedule, now)
+
+	data, err := redis.HGet(batchSchedulesKey, schedule.ID).Result()
+	if err != nil {
+		t.Fatalf("Unable to get the schedule: %s", err)
+	}
+	saved, err := loadBatchSchedule(schedule.ID, data)
+	if err != nil {
+		t.Fatalf("Unable to load the schedule: %s", err)
+	} else if !saved.NextRun.After(now) {
+		t.Errorf("Expected the schedule to move on past %s, got %s", now, saved.NextRun)
+	} else if saved.LastRun == nil || !saved.LastRun.Equal(runAt) {
+		t.Errorf("Expected the last run to be %s, got %v", runAt, saved.LastRun)
+	}
+
+	if runs, _ := redis.LLen(batchScheduleRunsKey(schedule.ID)).Result(); runs != 0 {
+		t.Errorf("Expected the run not to happen again, got %d runs", runs)
+	}
+}
@@ -0,0 +1,144 @@
+package model
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"gopkg.in/redis.v2"
+)
+
+var SCHEDULER_POLL int = 1000
+var SCHEDULER_LEASE int = 60
+var SCHEDULER_BATCH int64 = 100
+
+// The sorted set of scheduled async batch jobs, scored by the unix time they should run at
+const asyncScheduleKey = "batch:scheduled"
+
+// Claims the scheduled jobs that are due by pushing their score forward by the lease.  If the
+// worker dies before enqueueing a job, the job becomes due again once the lease runs out.
+const claimScheduledScript = `
+local due = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1], "LIMIT", 0, ARGV[3])
+for _, requestID in ipairs(due) do
+	redis.call("ZADD", KEYS[1], ARGV[2], requestID)
+end
+return due
+`
+
+// Schedules an async batch job, whose items are already saved, to be sent to the workers at runAt
+func ScheduleAsyncJob(redis *redis.Client, requestID string, runAt time.Time) error {
+	scheduleCmd := redis.ZAdd(asyncScheduleKey, redisZ(float64(runAt.Unix()), requestID))
+	if _, err := scheduleCmd.Result(); err != nil {
+		countRedisError("schedule_job")
+		log.Printf("An error occurred scheduling async batch job in Redis: [request id: %s] (error: %s)", requestID, err)
+		return err
+	}
+
+	log.Printf("Async batch job scheduled: [request id: %s] [run at: %s]", requestID, runAt)
+	return nil
+}
+
+// Removes an async batch job from the schedule
+func unscheduleAsyncJob(redis *redis.Client, requestID string) {
+	remCmd := redis.ZRem(asyncScheduleKey, requestID)
+	if _, err := remCmd.Result(); err != nil {
+		log.Printf("An error occurred removing async batch job from the schedule: [request id: %s] (error: %s)", requestID, err)
+	}
+}
+
+// Sends the batch items of a scheduled async batch job to the workers
+func enqueueScheduledJob(redis *redis.Client, requestID string) error {
+	job, err := GetAsyncJob(redis, requestID)
+	if err != nil || job.Status != AsyncJobScheduled {
+		// The job expired or was cancelled, so there's nothing left to run
+		log.Printf("Scheduled async batch job no longer runnable: [request id: %s] [status: %s]", requestID, job.Status)
+		unscheduleAsyncJob(redis, requestID)
+		return nil
+	}
+
+	batchItems, err := getAsyncJobItems(redis, requestID)
+	if err != nil {
+		return err
+	}
+
+	if int64(len(batchItems)) != job.Total {
+		return fmt.Errorf("Scheduled async batch job %s has %d items saved, expected %d", requestID, len(batchItems), job.Total)
+	}
+
+	if err := UpdateAsyncJob(redis, requestID, "status", AsyncJobPending); err != nil {
+		return err
+	}
+
+	if err := batchItems.enqueueAsync(job); err != nil {
+		// The whole job is sent again once the lease runs out.  Items that were already sent
+		// are only processed once, since the workers claim each item before running it.
+		UpdateAsyncJob(redis, requestID, "status", AsyncJobScheduled)
+		return err
+	}
+
+	unscheduleAsyncJob(redis, requestID)
+	log.Printf("Scheduled async batch job sent to workers: [request id: %s] [items: %d]", requestID, len(batchItems))
+	return nil
+}
+
+// Sends all of the scheduled async batch jobs that are due to the workers
+func runScheduledJobs(redis *redis.Client) {
+	now := time.Now()
+	lease := now.Add(time.Duration(SCHEDULER_LEASE) * time.Second)
+
+	claimCmd := redis.Eval(claimScheduledScript, []string{asyncScheduleKey}, []string{
+		strconv.FormatInt(now.Unix(), 10),
+		strconv.FormatInt(lease.Unix(), 10),
+		strconv.FormatInt(SCHEDULER_BATCH, 10),
+	})
+	claimResult, err := claimCmd.Result()
+	if err != nil {
+		countRedisError("claim_schedule")
+		log.Printf("An error occurred claiming scheduled async batch jobs: %s", err)
+		return
+	}
+
+	due, _ := claimResult.([]interface{})
+	for _, requestID := range due {
+		requestID, _ := requestID.(string)
+		if err := enqueueScheduledJob(redis, requestID); err != nil {
+			log.Printf("An error occurred sending scheduled async batch job to the workers. Retrying after %d seconds: [request id: %s] (error: %s)", SCHEDULER_LEASE, requestID, err)
+		}
+	}
+}
+
+// Starts the background task that sends scheduled async batch jobs to the workers, and delivers
+// pending callbacks, when they're due.  Both are kept in redis, so any number of these can run
+// and they survive restarts.
+func StartAsyncScheduler(quit chan bool, finished chan bool) {
+	redis := GetAsyncJobRedis()
+	defer redis.Close()
+
+	log.Println("Async scheduler started")
+
+	ticker := time.NewTicker(time.Duration(SCHEDULER_POLL) * time.Millisecond)
+	defer ticker.Stop()
+
+	// Offloaded response bodies are cleaned up here too, since there's one of these per worker process
+	var cleanup <-chan time.Time
+	if interval := blobCleanupInterval(); interval > 0 {
+		cleanupTicker := time.NewTicker(interval)
+		defer cleanupTicker.Stop()
+		cleanup = cleanupTicker.C
+	}
+
+	for {
+		select {
+		case <-quit:
+			log.Println("Interrupt detected. Stopping async scheduler")
+			finished <- true
+			return
+		case <-ticker.C:
+			runScheduledJobs(redis)
+			runPendingCallbacks(redis)
+		case <-cleanup:
+			cleanupBlobStore(redis)
+		}
+	}
+}
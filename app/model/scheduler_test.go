@@ -0,0 +1,72 @@
+package model
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduledFor(t *testing.T) {
+	runAt := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		options  AsyncBatchOptions
+		expected time.Duration
+		zero     bool
+	}{
+		{"right away", AsyncBatchOptions{}, 0, true},
+		{"run at", AsyncBatchOptions{RunAt: &runAt}, 0, false},
+		{"delayed", AsyncBatchOptions{DelaySeconds: 60}, time.Minute, false},
+	}
+
+	for _, test := range tests {
+		scheduledFor := test.options.ScheduledFor()
+		switch {
+		case test.zero:
+			if !scheduledFor.IsZero() {
+				t.Errorf("%s: expected to run right away, got %s", test.name, scheduledFor)
+			}
+		case test.options.RunAt != nil:
+			if !scheduledFor.Equal(runAt) {
+				t.Errorf("%s: got %s, expected %s", test.name, scheduledFor, runAt)
+			}
+		default:
+			if delay := time.Until(scheduledFor); delay > test.expected || delay < test.expected-5*time.Second {
+				t.Errorf("%s: scheduled in %s, expected %s", test.name, delay, test.expected)
+			}
+		}
+	}
+}
+
+func TestRunScheduledJobs(t *testing.T) {
+	redis := testRedis(t)
+	defer redis.Close()
+
+	// A due job that was cancelled is taken off the schedule without being sent to the workers
+	cancelled := testAsyncJob(t, redis, AsyncJobCancelled, "")
+	// A job that isn't due yet is left alone
+	later := testAsyncJob(t, redis, AsyncJobScheduled, "")
+	t.Cleanup(func() {
+		unscheduleAsyncJob(redis, cancelled)
+		unscheduleAsyncJob(redis, later)
+	})
+
+	runAt := time.Now().Add(time.Hour)
+	if err := ScheduleAsyncJob(redis, cancelled, time.Now().Add(-time.Minute)); err != nil {
+		t.Fatalf("Unable to schedule the job: %s", err)
+	} else if err := ScheduleAsyncJob(redis, later, runAt); err != nil {
+		t.Fatalf("Unable to schedule the job: %s", err)
+	}
+
+	runScheduledJobs(redis)
+
+	if _, err := redis.ZScore(asyncScheduleKey, cancelled).Result(); !IsRedisNil(err) {
+		t.Errorf("Expected the cancelled job to be taken off the schedule")
+	}
+	if at, err := redis.ZScore(asyncScheduleKey, later).Result(); err != nil || at != float64(runAt.Unix()) {
+		t.Errorf("Expected the later job to stay scheduled for %d, got %f (error: %v)", runAt.Unix(), at, err)
+	}
+	if status, _ := redis.HGet(AsyncJobKey(later), "status").Result(); status != AsyncJobScheduled {
+		t.Errorf("Expected the later job to still be scheduled, got %q", status)
+	}
+}
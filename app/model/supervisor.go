@@ -0,0 +1,136 @@
+package model
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"sync"
+	"time"
+)
+
+var WORKER_RESTART_BACKOFF int = 1000
+var WORKER_RESTART_MAX_BACKOFF int = 60000
+var WORKER_CRASH_LIMIT int = 5
+var WORKER_CRASH_WINDOW int = 300
+
+// The health statuses of the async workers
+const (
+	AsyncWorkerStarting   = "starting"
+	AsyncWorkerRunning    = "running"
+	AsyncWorkerRestarting = "restarting"
+	AsyncWorkerFailed     = "failed"
+	AsyncWorkerStopped    = "stopped"
+)
+
+// The health of the async workers in this process
+type AsyncWorkerHealth struct {
+	Status      string     `json:"status"`
+	Restarts    int        `json:"restarts"`
+	LastError   string     `json:"lastError,omitempty"`
+	LastErrorAt *time.Time `json:"lastErrorAt,omitempty"`
+	Heartbeat   time.Time  `json:"heartbeat"`
+	Updated     time.Time  `json:"updated"`
+}
+
+var asyncWorkerHealth = AsyncWorkerHealth{Status: AsyncWorkerStopped}
+var asyncWorkerHealthLock sync.Mutex
+
+func init() {
+	expvar.Publish("asyncWorkerHealth", expvar.Func(func() interface{} {
+		return GetAsyncWorkerHealth()
+	}))
+}
+
+// Get the health of the async workers in this process
+func GetAsyncWorkerHealth() AsyncWorkerHealth {
+	asyncWorkerHealthLock.Lock()
+	defer asyncWorkerHealthLock.Unlock()
+	return asyncWorkerHealth
+}
+
+// Records a change in the health of the async workers.  err is the reason for the change, if any.
+func setAsyncWorkerHealth(status string, err error) {
+	asyncWorkerHealthLock.Lock()
+	defer asyncWorkerHealthLock.Unlock()
+
+	now := time.Now()
+	asyncWorkerHealth.Status = status
+	asyncWorkerHealth.Updated = now
+	if status == AsyncWorkerRestarting {
+		asyncWorkerHealth.Restarts++
+	}
+	if err != nil {
+		asyncWorkerHealth.LastError = err.Error()
+		asyncWorkerHealth.LastErrorAt = &now
+		recordAsyncWorkerError(-1, nil, err)
+	}
+}
+
+// Records that the loop reading and handing out messages to the workers is still running
+func beatAsyncWorkerHealth() {
+	asyncWorkerHealthLock.Lock()
+	defer asyncWorkerHealthLock.Unlock()
+
+	asyncWorkerHealth.Heartbeat = time.Now()
+}
+
+// Starts the background task that reads asynchronous batch items from kafka and processes them
+// with a pool of workers, see runAsyncConsumer.  If it dies it is restarted after a backoff that
+// doubles with every crash, up to WORKER_RESTART_MAX_BACKOFF.  If it crashes more than
+// WORKER_CRASH_LIMIT times within WORKER_CRASH_WINDOW seconds it is left stopped and reported
+// as failed.
+func StartAsyncWorker(ctx context.Context, numWorkers int, quit chan bool, finished chan bool) {
+	window := time.Duration(WORKER_CRASH_WINDOW) * time.Second
+	backoff := time.Duration(WORKER_RESTART_BACKOFF) * time.Millisecond
+	crashes := []time.Time{}
+
+	for {
+		setAsyncWorkerHealth(AsyncWorkerStarting, nil)
+		started := time.Now()
+
+		err := runAsyncConsumer(ctx, numWorkers, quit)
+		if err == nil {
+			setAsyncWorkerHealth(AsyncWorkerStopped, nil)
+			finished <- true
+			return
+		}
+
+		// A worker that ran for a while before dying isn't in a crash loop, so it starts over
+		now := time.Now()
+		if now.Sub(started) > window {
+			backoff = time.Duration(WORKER_RESTART_BACKOFF) * time.Millisecond
+		}
+
+		recent := []time.Time{now}
+		for _, crash := range crashes {
+			if now.Sub(crash) <= window {
+				recent = append(recent, crash)
+			}
+		}
+		crashes = recent
+
+		if len(crashes) > WORKER_CRASH_LIMIT {
+			log.Printf("Worker crashed %d times within %s. Not restarting it again. (error: %s)", len(crashes), window, err)
+			setAsyncWorkerHealth(AsyncWorkerFailed, err)
+			<-quit
+			finished <- true
+			return
+		}
+
+		log.Printf("Worker died. Restarting in %s: [crashes: %d] (error: %s)", backoff, len(crashes), err)
+		setAsyncWorkerHealth(AsyncWorkerRestarting, err)
+
+		select {
+		case <-quit:
+			setAsyncWorkerHealth(AsyncWorkerStopped, nil)
+			finished <- true
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if maxBackoff := time.Duration(WORKER_RESTART_MAX_BACKOFF) * time.Millisecond; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var TRACE_EXPORTER string = ""
+var TRACE_FILE string = "/tmp/batch-traces.json"
+var TRACE_SAMPLE_RATIO float64 = 1
+var TRACE_SERVICE_NAME string = "batch"
+
+// The tracer for the spans of the batches and their items
+var tracer = otel.Tracer("github.com/johnnadratowski/batch")
+
+// Starts exporting traces to TRACE_EXPORTER, which is "otlp", "file", or empty to not export
+// them.  The W3C trace context is passed on either way, so requests that come in as part of a
+// trace keep it in the downstream requests.  Returns a func that flushes the traces on shutdown.
+func InitTracing() (func(), error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch TRACE_EXPORTER {
+	case "":
+		return func() {}, nil
+	case "otlp":
+		// Configured with the standard OTEL_EXPORTER_OTLP_* env variables
+		exporter, err = otlptracehttp.New(context.Background())
+	case "file":
+		var file *os.File
+		file, err = os.OpenFile(TRACE_FILE, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err == nil {
+			exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+		}
+	default:
+		err = fmt.Errorf("Unknown trace exporter: %s", TRACE_EXPORTER)
+	}
+	if err != nil {
+		log.Printf("An error occurred starting the trace exporter: [exporter: %s] (error: %s)", TRACE_EXPORTER, err)
+		return func() {}, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(TRACE_SAMPLE_RATIO))),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", TRACE_SERVICE_NAME),
+			attribute.String("service.version", BUILD_VERSION),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+
+	log.Printf("Tracing started: [exporter: %s] [sample ratio: %g]", TRACE_EXPORTER, TRACE_SAMPLE_RATIO)
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			log.Printf("An error occurred flushing traces: %s", err)
+		}
+	}, nil
+}
+
+// Starts a span for a request to the webserver, joining the trace of the request's traceparent header if it has one
+func StartHTTPSpan(request *http.Request) (context.Context, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(request.Context(), propagation.HeaderCarrier(request.Header))
+	return tracer.Start(ctx, request.Method+" "+request.URL.Path,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.method", request.Method),
+			attribute.String("http.target", request.URL.Path),
+		))
+}
+
+// Adds the traceparent header of the span in ctx to a downstream request
+func injectTraceHeaders(ctx context.Context, request *http.Request) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(request.Header))
+}
+
+// Get the trace context of the span in ctx, so it can be carried to the workers with the async batch items
+func traceContextOf(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
+
+// Get a context holding the trace an async batch item was sent with, so the worker's spans join it
+func contextWithTrace(ctx context.Context, traceContext map[string]string) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(traceContext))
+}
+
+// Starts the span for a single batch item
+func startItemSpan(ctx context.Context, batchItem BatchItem) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "batch.item",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("batch.item.method", batchItem.Method),
+			attribute.String("batch.item.service", batchItem.Service()),
+		))
+}
+
+// Ends the span for a single batch item, with the status code of its response
+func endItemSpan(span trace.Span, response BatchResponseItem, err error) {
+	if err == nil {
+		span.SetAttributes(attribute.Int("http.status_code", response.Code))
+		if response.Code >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(response.Code))
+		}
+	}
+	endSpan(span, err)
+}
+
+// Ends a span, recording the error if there was one
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
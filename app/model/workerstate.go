@@ -0,0 +1,203 @@
+package model
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+var WORKER_ERROR_HISTORY int = 50
+var WORKER_STUCK_TIMEOUT int = 60
+
+// The states of a single async worker
+const (
+	AsyncWorkerIdle       = "idle"
+	AsyncWorkerProcessing = "processing"
+)
+
+// What a single async worker in the pool is doing
+type AsyncWorkerState struct {
+	ID        int       `json:"id"`
+	State     string    `json:"state"`
+	RequestID string    `json:"requestId,omitempty"`
+	Index     int64     `json:"idx"`
+	Since     time.Time `json:"since"`
+	Processed int64     `json:"processed"`
+}
+
+// An error that happened in the async workers
+type AsyncWorkerError struct {
+	At        time.Time `json:"at"`
+	Worker    int       `json:"worker"`
+	RequestID string    `json:"requestId,omitempty"`
+	Index     int64     `json:"idx"`
+	Error     string    `json:"error"`
+}
+
+var asyncWorkerStates = map[int]*AsyncWorkerState{}
+var asyncWorkerErrors = []AsyncWorkerError{}
+var asyncWorkerStateLock sync.Mutex
+
+// Records that a worker is waiting for a message
+func setAsyncWorkerIdle(workerNum int) {
+	asyncWorkerStateLock.Lock()
+	defer asyncWorkerStateLock.Unlock()
+
+	state, ok := asyncWorkerStates[workerNum]
+	if !ok {
+		state = &AsyncWorkerState{ID: workerNum}
+		asyncWorkerStates[workerNum] = state
+	} else if state.State == AsyncWorkerProcessing {
+		state.Processed++
+	}
+
+	state.State = AsyncWorkerIdle
+	state.RequestID = ""
+	state.Index = 0
+	state.Since = time.Now()
+}
+
+// Records the item a worker started processing
+func setAsyncWorkerProcessing(workerNum int, requestID string, index int64) {
+	asyncWorkerStateLock.Lock()
+	defer asyncWorkerStateLock.Unlock()
+
+	state, ok := asyncWorkerStates[workerNum]
+	if !ok {
+		state = &AsyncWorkerState{ID: workerNum}
+		asyncWorkerStates[workerNum] = state
+	}
+
+	state.State = AsyncWorkerProcessing
+	state.RequestID = requestID
+	state.Index = index
+	state.Since = time.Now()
+}
+
+// Forgets a worker that stopped
+func removeAsyncWorkerState(workerNum int) {
+	asyncWorkerStateLock.Lock()
+	defer asyncWorkerStateLock.Unlock()
+
+	delete(asyncWorkerStates, workerNum)
+}
+
+// Get what each async worker in this process is doing
+func ListAsyncWorkerStates() []AsyncWorkerState {
+	asyncWorkerStateLock.Lock()
+	defer asyncWorkerStateLock.Unlock()
+
+	states := make([]AsyncWorkerState, 0, len(asyncWorkerStates))
+	for _, state := range asyncWorkerStates {
+		states = append(states, *state)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].ID < states[j].ID })
+	return states
+}
+
+// Records an error processing a message, keeping the last WORKER_ERROR_HISTORY of them.  The
+// worker is -1 for errors that aren't from a single worker.
+func recordAsyncWorkerError(workerNum int, message *sarama.ConsumerMessage, err error) {
+	workerError := AsyncWorkerError{
+		At:     time.Now(),
+		Worker: workerNum,
+		Error:  err.Error(),
+	}
+	if message != nil {
+		workerError.RequestID, workerError.Index = asyncMessageItem(message)
+		if workerError.RequestID == "" {
+			workerError.Error = fmt.Sprintf("%s [offset: %d] [partition: %d] [topic: %s]", err, message.Offset, message.Partition, message.Topic)
+		}
+	}
+
+	asyncWorkerStateLock.Lock()
+	defer asyncWorkerStateLock.Unlock()
+
+	asyncWorkerErrors = append(asyncWorkerErrors, workerError)
+	if overflow := len(asyncWorkerErrors) - WORKER_ERROR_HISTORY; overflow > 0 {
+		asyncWorkerErrors = asyncWorkerErrors[overflow:]
+	}
+}
+
+// Get the most recent errors in the async workers, oldest first
+func RecentAsyncWorkerErrors() []AsyncWorkerError {
+	asyncWorkerStateLock.Lock()
+	defer asyncWorkerStateLock.Unlock()
+
+	return append([]AsyncWorkerError{}, asyncWorkerErrors...)
+}
+
+// Get the request ID and index of the item in a message, without the rest of it
+func asyncMessageItem(message *sarama.ConsumerMessage) (string, int64) {
+	envelope, _ := decodeAsyncMessage(message.Value)
+	return envelope.Item.RequestID, envelope.Item.Index
+}
+
+// Get the worker that has been processing its item the longest, if any are processing one
+func oldestProcessingAsyncWorker() (AsyncWorkerState, bool) {
+	asyncWorkerStateLock.Lock()
+	defer asyncWorkerStateLock.Unlock()
+
+	var oldest AsyncWorkerState
+	found := false
+	for _, state := range asyncWorkerStates {
+		if state.State == AsyncWorkerProcessing && (!found || state.Since.Before(oldest.Since)) {
+			oldest = *state
+			found = true
+		}
+	}
+	return oldest, found
+}
+
+// Get how long a worker can be on one item before it's stuck.  Each of the item's attempts can
+// take up to ITEM_REQUEST_TIMEOUT, with the backoffs in between, and WORKER_STUCK_TIMEOUT is
+// allowed on top of that for claiming the item and saving its result.
+func asyncItemStuckTimeout() time.Duration {
+	timeout := time.Duration(ASYNC_ITEM_ATTEMPTS*ITEM_REQUEST_TIMEOUT+WORKER_STUCK_TIMEOUT) * time.Second
+	backoff := time.Duration(ASYNC_ITEM_BACKOFF) * time.Millisecond
+	for attempt := 1; attempt < ASYNC_ITEM_ATTEMPTS; attempt++ {
+		timeout += backoff
+		backoff *= 2
+	}
+	return timeout
+}
+
+// Checks the async workers haven't failed or stopped making progress.  They're stuck if the
+// loop handing out messages stopped, or a worker has been on the same item for longer than
+// asyncItemStuckTimeout.
+func AsyncWorkersLive() error {
+	health := GetAsyncWorkerHealth()
+	if health.Status == AsyncWorkerFailed {
+		return fmt.Errorf("The workers have failed: %s", health.LastError)
+	} else if health.Status != AsyncWorkerRunning {
+		return nil
+	}
+
+	stuck := asyncItemStuckTimeout()
+	if time.Since(health.Heartbeat) > stuck {
+		return fmt.Errorf("The workers have not handed out messages since %s", health.Heartbeat)
+	}
+
+	if oldest, ok := oldestProcessingAsyncWorker(); ok && time.Since(oldest.Since) > stuck {
+		return fmt.Errorf("Worker %d has been processing the same item since %s: [request id: %s] [idx: %d]", oldest.ID, oldest.Since, oldest.RequestID, oldest.Index)
+	}
+	return nil
+}
+
+// Checks the async workers are connected to kafka and redis, and can take messages
+func AsyncWorkersReady() error {
+	if health := GetAsyncWorkerHealth(); health.Status != AsyncWorkerRunning {
+		return fmt.Errorf("The workers are not connected to kafka: [status: %s]", health.Status)
+	}
+
+	redis := GetAsyncJobRedis()
+	defer redis.Close()
+
+	if _, err := redis.Ping().Result(); err != nil {
+		return fmt.Errorf("Redis is not reachable: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package model
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAsyncItemStuckTimeout(t *testing.T) {
+	defer func(attempts, backoff, timeout, stuck int) {
+		ASYNC_ITEM_ATTEMPTS, ASYNC_ITEM_BACKOFF, ITEM_REQUEST_TIMEOUT, WORKER_STUCK_TIMEOUT = attempts, backoff, timeout, stuck
+	}(ASYNC_ITEM_ATTEMPTS, ASYNC_ITEM_BACKOFF, ITEM_REQUEST_TIMEOUT, WORKER_STUCK_TIMEOUT)
+
+	tests := []struct {
+		name     string
+		attempts int
+		backoff  int
+		timeout  int
+		stuck    int
+		expected time.Duration
+	}{
+		{"one attempt", 1, 500, 60, 60, 120 * time.Second},
+		{"with backoffs", 3, 500, 60, 60, 240*time.Second + 1500*time.Millisecond},
+		{"no margin", 2, 1000, 10, 0, 21 * time.Second},
+	}
+
+	for _, test := range tests {
+		ASYNC_ITEM_ATTEMPTS, ASYNC_ITEM_BACKOFF, ITEM_REQUEST_TIMEOUT, WORKER_STUCK_TIMEOUT = test.attempts, test.backoff, test.timeout, test.stuck
+		if timeout := asyncItemStuckTimeout(); timeout != test.expected {
+			t.Errorf("%s: got %s, expected %s", test.name, timeout, test.expected)
+		}
+	}
+}
@@ -15,20 +15,62 @@ func Router() (root *web.Router) {
 	root = web.New(context.Context{})
 
 	root.Middleware(web.ShowErrorsMiddleware)
+	root.Middleware(controller.RequestMetrics)
+	root.Middleware(controller.Tracing)
 
 	root.Error(controller.Error)
 
 	// Leave in here as simple test route for load balancers and such
 	root.Get("/ping", controller.Ping)
+	root.Get("/metrics", controller.Metrics)
 
 	// Catch-all Route
 	root.NotFound(controller.NotFound)
 
 	batchRoot := root.Subrouter(context.Context{}, "/")
 
+	batchRoot.Middleware(controller.Idempotency)
+
 	batchRoot.Post("/batch", controller.Batch)
 	batchRoot.Post("/batch/async", controller.AsyncBatch)
 	batchRoot.Get("/batch/async/:requestID", controller.AsyncBatchRetrieve)
+	batchRoot.Delete("/batch/async/:requestID", controller.AsyncBatchCancel)
+	batchRoot.Get("/batch/async/:requestID/status", controller.AsyncBatchStatus)
+	batchRoot.Post("/batch/async/:requestID/retry", controller.AsyncBatchRetry)
+	batchRoot.Get("/batch/async/:requestID/items/:index/body", controller.AsyncBatchItemBody)
+
+	batchRoot.Post("/batch/schedules", controller.ScheduleCreate)
+	batchRoot.Get("/batch/schedules", controller.ScheduleList)
+	batchRoot.Get("/batch/schedules/:scheduleID", controller.ScheduleRetrieve)
+	batchRoot.Put("/batch/schedules/:scheduleID", controller.ScheduleUpdate)
+	batchRoot.Delete("/batch/schedules/:scheduleID", controller.ScheduleDelete)
+
+	return
+}
+
+// WorkerRouter handles the requests to the optional HTTP listener of the worker command
+func WorkerRouter() (root *web.Router) {
+	root = web.New(context.Context{})
+
+	root.Middleware(web.ShowErrorsMiddleware)
+
+	root.Error(controller.Error)
+
+	root.NotFound(controller.NotFound)
+
+	root.Get("/ping", controller.Ping)
+	root.Get("/health/live", controller.WorkerLive)
+	root.Get("/health/ready", controller.WorkerReady)
+	root.Get("/workers", controller.WorkerList)
+	root.Get("/errors", controller.WorkerErrors)
+
+	// Dead letters hold the items of every identity, so they're only served on the internal listener
+	root.Get("/deadletters", controller.DeadLetterList)
+	root.Get("/deadletters/:deadLetterID", controller.DeadLetterRetrieve)
+	root.Post("/deadletters/:deadLetterID/replay", controller.DeadLetterReplay)
+
+	root.Get("/vars", controller.Vars)
+	root.Get("/metrics", controller.Metrics)
 
 	return
 }
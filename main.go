@@ -1,17 +1,20 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
+	"github.com/codegangsta/cli"
 	"github.com/johnnadratowski/batch/app/command"
 	"github.com/johnnadratowski/batch/app/model"
 	"github.com/johnnadratowski/batch/app/route"
 	"github.com/johnnadratowski/batch/app/server"
-	"github.com/codegangsta/cli"
 )
 
 var HOST string = ""
@@ -26,11 +29,14 @@ func main() {
 	if len(os.Args) == 1 {
 		log.Println("Starting Batch Server")
 
+		// Traces are still passed on to downstream requests if the exporter can't start
+		shutdownTracing, _ := model.InitTracing()
+
 		listen := fmt.Sprintf("%s:%s", HOST, PORT)
 
 		server := &http.Server{
-			Addr:           listen,
-			Handler:        route.Router(),
+			Addr:    listen,
+			Handler: route.Router(),
 		}
 
 		quit := make(chan bool, 1)
@@ -40,8 +46,27 @@ func main() {
 			go model.StartAsyncWorkers(numWorkers, quit, finished)
 		}
 
+		// Stop taking new connections on a signal, and give the open requests time to finish
+		shutdown := make(chan bool, 1)
+		go func() {
+			catchSignal := make(chan os.Signal, 1)
+			signal.Notify(catchSignal, os.Interrupt, syscall.SIGTERM)
+			sig := <-catchSignal
+			log.Printf("Caught %s signal. Shutting down Batch Server", sig)
+
+			ctx, cancel := context.WithTimeout(context.Background(), model.DrainTimeout())
+			defer cancel()
+			if err := server.Shutdown(ctx); err != nil {
+				log.Printf("Batch Server DID NOT shut down cleanly: %s", err)
+			}
+			shutdown <- true
+		}()
+
 		err := server.ListenAndServe()
 		log.Printf("Exiting Batch Server: %s", err)
+		if err == http.ErrServerClosed {
+			<-shutdown
+		}
 
 		if numWorkers > 0 {
 			log.Println("Quitting workers")
@@ -50,10 +75,13 @@ func main() {
 			select {
 			case <-finished:
 				log.Println("All workers finished. Shutdown successfully")
-			case <-time.After(3 * time.Second):
+			case <-time.After(model.DrainTimeout() + 3*time.Second):
 				log.Println("All workers DID NOT finished. Forcefully shutting down")
 			}
 		}
+
+		model.CloseAsyncBatchProducer()
+		shutdownTracing()
 	} else {
 		app := cli.NewApp()
 		app.Name = "Batch"